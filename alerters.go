@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The alerter processRule uses when a rule does not set one.
+const prometheusAlerter = "elastalert_modules.prometheus_alertmanager.PrometheusAlertManagerAlerter"
+
+/*
+ The options of an elastalert alerter. Options listed in urls must hold http(s)
+ URLs.
+*/
+type alerterSchema struct {
+	required []string
+	optional []string
+	urls     []string
+}
+
+var alerterSchemas = map[string]alerterSchema{
+	"debug": {},
+	"email": {
+		required: []string{"email"},
+		optional: []string{"cc", "bcc", "from_addr", "email_reply_to", "smtp_host", "smtp_port", "smtp_ssl", "smtp_auth_file"},
+	},
+	"jira": {
+		required: []string{"jira_server", "jira_project", "jira_issuetype", "jira_account_file"},
+		optional: []string{"jira_labels", "jira_components"},
+		urls:     []string{"jira_server"},
+	},
+	"command": {
+		required: []string{"command"},
+	},
+	"slack": {
+		required: []string{"slack_webhook_url"},
+		urls:     []string{"slack_webhook_url"},
+	},
+	"pagerduty": {
+		required: []string{"pagerduty_service_key", "pagerduty_client_name"},
+	},
+	"hipchat": {
+		required: []string{"hipchat_auth_token", "hipchat_room_id"},
+	},
+	"sns": {
+		required: []string{"sns_topic_arn"},
+	},
+	"telegram": {
+		required: []string{"telegram_bot_token", "telegram_room_id"},
+	},
+	"victorops": {
+		required: []string{"victorops_api_key", "victorops_routing_key", "victorops_message_type"},
+	},
+	"gitter": {
+		required: []string{"gitter_webhook_url"},
+		urls:     []string{"gitter_webhook_url"},
+	},
+	"servicenow": {
+		required: []string{"username", "password", "servicenow_rest_url", "short_description", "comments", "assignment_group", "category", "subcategory", "cmdb_ci", "caller_id"},
+		urls:     []string{"servicenow_rest_url"},
+	},
+	"post": {
+		required: []string{"http_post_url"},
+		optional: []string{"http_post_payload", "http_post_headers"},
+		urls:     []string{"http_post_url"},
+	},
+	"opsgenie": {
+		required: []string{"opsgenie_key"},
+	},
+	"twilio": {
+		required: []string{"twilio_account_sid", "twilio_auth_token", "twilio_to_number", "twilio_from_number"},
+	},
+	"exotel": {
+		required: []string{"exotel_account_sid", "exotel_auth_token", "exotel_to_number", "exotel_from_number"},
+	},
+	prometheusAlerter: {
+		required: []string{"alertmanager_url"},
+		urls:     []string{"alertmanager_url"},
+	},
+}
+
+// Types of alerter options. Options not listed here, such as tokens and room ids,
+// only have to be present.
+var alerterOptionKinds = map[string]optionKind{
+	"email":             optStringOrList,
+	"cc":                optStringOrList,
+	"bcc":               optStringOrList,
+	"command":           optStringOrList,
+	"slack_webhook_url": optStringOrList,
+	"http_post_url":     optStringOrList,
+	"smtp_port":         optInt,
+	"smtp_ssl":          optBool,
+	"jira_labels":       optStringOrList,
+	"jira_components":   optStringOrList,
+	"http_post_payload": optMap,
+	"http_post_headers": optMap,
+}
+
+var alerterOptionValues = map[string][]string{
+	"victorops_message_type": {"INFO", "WARNING", "ACKNOWLEDGEMENT", "CRITICAL", "RECOVERY"},
+}
+
+/*
+ Checks the alerters a rule selects with 'alert', which is a single alerter, a list
+ of alerters, or a list of {alerter: {options}} maps whose options override those of
+ the rule. Alerters given as a module path are only checked if they are known.
+*/
+func validateAlerts(ruleMap map[string]interface{}, errs *ruleErrors) {
+	switch alert := ruleMap["alert"].(type) {
+	case nil:
+		// reported as a missing option
+	case string:
+		validateAlerter(alert, ruleMap, nil, errs)
+	case []interface{}:
+		if len(alert) == 0 {
+			errs.add("alert", "must select at least one alerter")
+		}
+		for _, item := range alert {
+			switch item := item.(type) {
+			case string:
+				validateAlerter(item, ruleMap, nil, errs)
+			case map[interface{}]interface{}:
+				for name, options := range item {
+					overrides, ok := options.(map[interface{}]interface{})
+					if !ok && options != nil {
+						errs.add(fmt.Sprintf("alert[%v]", name), "options must be a map")
+						continue
+					}
+					validateAlerter(fmt.Sprint(name), ruleMap, overrides, errs)
+				}
+			default:
+				errs.add("alert", "entries must be an alerter name or a map of alerter options")
+			}
+		}
+	default:
+		errs.add("alert", "must be an alerter name or a list of alerters")
+	}
+}
+
+func validateAlerter(name string, ruleMap map[string]interface{}, overrides map[interface{}]interface{}, errs *ruleErrors) {
+	field := fmt.Sprintf("alert[%s]", name)
+	schema, ok := alerterSchemas[name]
+	if !ok {
+		if !strings.Contains(name, ".") {
+			errs.add(field, "unknown alerter, expected one of %s or a module path", strings.Join(alerterNames(), ", "))
+		}
+		return
+	}
+
+	option := func(key string) (interface{}, bool) {
+		if value, ok := overrides[key]; ok {
+			return value, true
+		}
+		value, ok := ruleMap[key]
+		return value, ok
+	}
+
+	for _, key := range schema.required {
+		if _, ok := option(key); !ok {
+			errs.add(field, "%s: is required by the %s alerter", key, name)
+		}
+	}
+
+	keys := append(append([]string{}, schema.required...), schema.optional...)
+	for _, key := range keys {
+		value, ok := option(key)
+		if !ok || isSecretRef(value) {
+			continue
+		}
+
+		if kind, ok := alerterOptionKinds[key]; ok {
+			if err := checkOption(kind, value); err != "" {
+				errs.add(field, "%s: %s", key, err)
+				continue
+			}
+		}
+		if allowed, ok := alerterOptionValues[key]; ok {
+			if s, _ := value.(string); !containsString(allowed, s) {
+				errs.add(field, "%s: must be one of %s", key, strings.Join(allowed, ", "))
+			}
+		}
+		if containsString(schema.urls, key) {
+			if err := checkURLs(value); err != "" {
+				errs.add(field, "%s: %s", key, err)
+			}
+		}
+	}
+}
+
+// checkURLs checks a URL option, which may hold a single URL or a list of them.
+func checkURLs(value interface{}) string {
+	var urls []string
+	switch value := value.(type) {
+	case string:
+		urls = append(urls, value)
+	case []interface{}:
+		for _, item := range value {
+			if !isSecretRef(item) {
+				urls = append(urls, fmt.Sprint(item))
+			}
+		}
+	default:
+		return "must be a URL"
+	}
+
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.HasPrefix(u.Host, ":") {
+			return fmt.Sprintf("%q is not an http(s) URL with a host", raw)
+		}
+	}
+	return ""
+}
+
+func alerterNames() []string {
+	var names []string
+	for name := range alerterSchemas {
+		if !strings.Contains(name, ".") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A valid value for every required alerter option. Other options get "x".
+var alerterTestValues = map[string]interface{}{
+	"email":                  "ops@example.com",
+	"command":                []interface{}{"/bin/true"},
+	"slack_webhook_url":      "https://hooks.slack.com/services/x",
+	"jira_server":            "https://jira.example.com",
+	"gitter_webhook_url":     "https://webhooks.gitter.im/e/x",
+	"servicenow_rest_url":    "https://example.service-now.com/api/now/table/incident",
+	"http_post_url":          "http://receiver:8080/alerts",
+	"alertmanager_url":       "http://alertmanager:9093/",
+	"victorops_message_type": "CRITICAL",
+}
+
+// alerterTestRule returns a valid rule selecting an alerter, with every option it requires.
+func alerterTestRule(t *testing.T, alerter string) map[string]interface{} {
+	rule := parseTestRule(t, "name: test\nindex: logs-*\ntype: any")
+	rule["alert"] = alerter
+	for _, option := range alerterSchemas[alerter].required {
+		value, ok := alerterTestValues[option]
+		if !ok {
+			value = "x"
+		}
+		rule[option] = value
+	}
+	return rule
+}
+
+func TestValidateAlerterRequiredOptions(t *testing.T) {
+	for alerter, schema := range alerterSchemas {
+		expectRuleErrors(t, alerter, validateRule(alerterTestRule(t, alerter)), nil)
+
+		for _, option := range schema.required {
+			rule := alerterTestRule(t, alerter)
+			delete(rule, option)
+			expectRuleErrors(t, alerter+" without "+option, validateRule(rule), []string{
+				fmt.Sprintf("alert[%s]: %s: is required by the %s alerter", alerter, option, alerter),
+			})
+		}
+	}
+}
+
+func TestValidateAlerterURLs(t *testing.T) {
+	tests := []struct {
+		url   interface{}
+		valid bool
+	}{
+		{"https://hooks.slack.com/services/x", true},
+		{"http://10.0.0.1:8080/hook", true},
+		{[]interface{}{"https://a.example.com", "https://b.example.com"}, true},
+		{"hooks.slack.com/services/x", false},
+		{"ftp://hooks.slack.com/x", false},
+		{"https:///x", false},
+		{"https://:443/x", false},
+		{"http://%zz", false},
+		{[]interface{}{"https://a.example.com", "b.example.com"}, false},
+		{5, false},
+	}
+
+	for _, test := range tests {
+		rule := alerterTestRule(t, "slack")
+		rule["slack_webhook_url"] = test.url
+		err := validateRule(rule)
+		if test.valid {
+			expectRuleErrors(t, fmt.Sprintf("URL %v", test.url), err, nil)
+			continue
+		}
+		errs := ruleErrorList(err)
+		if len(errs) != 1 || !strings.HasPrefix(errs[0], "alert[slack]: slack_webhook_url: ") {
+			t.Errorf("URL %v: got errors %q, expected one for slack_webhook_url", test.url, errs)
+		}
+	}
+
+	for _, alerter := range []string{"jira", "gitter", "servicenow", "post", prometheusAlerter} {
+		rule := alerterTestRule(t, alerter)
+		urlOption := alerterSchemas[alerter].urls[0]
+		rule[urlOption] = "not a url"
+		expectRuleErrors(t, alerter+" URL", validateRule(rule), []string{
+			fmt.Sprintf(`alert[%s]: %s: "not a url" is not an http(s) URL with a host`, alerter, urlOption),
+		})
+	}
+}
+
+func TestValidateAlerts(t *testing.T) {
+	alerters := strings.Join(alerterNames(), ", ")
+	tests := []struct {
+		desc     string
+		rule     string
+		expected []string
+	}{
+		{"single alerter", "alert: debug", nil},
+		{"list of alerters", "alert: [debug, slack]\nslack_webhook_url: https://hooks.slack.com/x", nil},
+		{"alerter options", "alert: [{slack: {slack_webhook_url: 'https://hooks.slack.com/x'}}]", nil},
+		{"alerter options override the rule", "alert: [{slack: {slack_webhook_url: 'https://hooks.slack.com/x'}}]\nslack_webhook_url: nope", nil},
+		{"alerter without options", "alert: [{debug: }]", nil},
+		{"missing option of a listed alerter", "alert: [debug, slack]", []string{
+			"alert[slack]: slack_webhook_url: is required by the slack alerter",
+		}},
+		{"no alerters", "alert: []", []string{"alert: must select at least one alerter"}},
+		{"not an alerter", "alert: 5", []string{"alert: must be an alerter name or a list of alerters"}},
+		{"not an alerter entry", "alert: [5]", []string{"alert: entries must be an alerter name or a map of alerter options"}},
+		{"options not a map", "alert: [{slack: 5}]", []string{"alert[slack]: options must be a map"}},
+		{"unknown alerter", "alert: bogus", []string{"alert[bogus]: unknown alerter, expected one of " + alerters + " or a module path"}},
+		{"module path alerter", "alert: my_alerters.MyAlerter", nil},
+		{"type of an option", "alert: email\nemail: ops@example.com\nsmtp_port: twenty-five", []string{
+			"alert[email]: smtp_port: must be an integer",
+		}},
+		{"fixed values", "alert: victorops\nvictorops_api_key: x\nvictorops_routing_key: x\nvictorops_message_type: LOUD", []string{
+			"alert[victorops]: victorops_message_type: must be one of INFO, WARNING, ACKNOWLEDGEMENT, CRITICAL, RECOVERY",
+		}},
+		{"secret reference skips the checks", "alert: slack\nslack_webhook_url: {secretKeyRef: {name: slack, key: url}}", nil},
+		{"secret reference in a URL list", "alert: slack\nslack_webhook_url: ['https://hooks.slack.com/x', {secretKeyRef: {name: slack, key: url}}]", nil},
+	}
+
+	for _, test := range tests {
+		rule := parseTestRule(t, "name: test\nindex: logs-*\ntype: any\n"+test.rule)
+		expectRuleErrors(t, test.desc, validateRule(rule), test.expected)
+	}
+}
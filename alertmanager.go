@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+	kselector "k8s.io/kubernetes/pkg/fields"
+)
+
+// Where the namespace of the loader's own pod is mounted.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+/*
+ Discovers the Alertmanager that rules alert through by watching its Service and
+ Endpoints. The URL is the service's cluster IP, or with useEndpoints a list with
+ the URL of every ready replica, so the alerter reaches all of them. onChange is
+ called whenever the URL changes. Once found, the URL is kept while the service is
+ gone or has no ready replicas, rather than rejecting every rule that relies on it.
+*/
+type AlertmanagerDiscovery struct {
+	namespace    string
+	name         string
+	portName     string
+	useEndpoints bool
+	onChange     func()
+
+	serviceStore        kcache.Store
+	serviceController   *kframework.Controller
+	endpointsStore      kcache.Store
+	endpointsController *kframework.Controller
+
+	mutex *sync.Mutex
+	url   interface{}
+}
+
+func NewAlertmanagerDiscovery(kubeClient *kclient.Client, namespace, name, portName string, useEndpoints bool, onChange func()) *AlertmanagerDiscovery {
+	discovery := &AlertmanagerDiscovery{
+		namespace:    namespace,
+		name:         name,
+		portName:     portName,
+		useEndpoints: useEndpoints,
+		onChange:     onChange,
+		mutex:        &sync.Mutex{},
+	}
+
+	handler := kframework.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { discovery.update() },
+		DeleteFunc: func(interface{}) { discovery.update() },
+		UpdateFunc: func(interface{}, interface{}) { discovery.update() },
+	}
+	selector := kselector.OneTermEqualSelector("metadata.name", name)
+	discovery.serviceStore, discovery.serviceController = kframework.NewInformer(
+		instrumentListWatch("services", namespace, kcache.NewListWatchFromClient(kubeClient, "services", namespace, selector)),
+		&kapi.Service{},
+		0,
+		handler,
+	)
+	discovery.endpointsStore, discovery.endpointsController = kframework.NewInformer(
+		instrumentListWatch("endpoints", namespace, kcache.NewListWatchFromClient(kubeClient, "endpoints", namespace, selector)),
+		&kapi.Endpoints{},
+		0,
+		handler,
+	)
+	return discovery
+}
+
+func (self *AlertmanagerDiscovery) Run(stopCh <-chan struct{}) {
+	go self.serviceController.Run(stopCh)
+	go self.endpointsController.Run(stopCh)
+}
+
+func (self *AlertmanagerDiscovery) HasSynced() bool {
+	return self == nil || (self.serviceController.HasSynced() && self.endpointsController.HasSynced())
+}
+
+// URL returns the last discovered URL, a string or a list of strings, or nil if
+// the Alertmanager was never found.
+func (self *AlertmanagerDiscovery) URL() interface{} {
+	if self == nil {
+		return nil
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.url
+}
+
+func (self *AlertmanagerDiscovery) update() {
+	var url interface{}
+	if urls := self.discover(); len(urls) > 0 {
+		if self.useEndpoints {
+			list := make([]interface{}, len(urls))
+			for i, u := range urls {
+				list[i] = u
+			}
+			url = list
+		} else {
+			url = urls[0]
+		}
+	}
+
+	self.mutex.Lock()
+	previous := self.url
+	if url != nil {
+		self.url = url
+	}
+	self.mutex.Unlock()
+
+	if url == nil {
+		if previous != nil {
+			log.Printf("Alertmanager service %s/%s not found, keeping %v.\n", self.namespace, self.name, previous)
+		} else {
+			log.Printf("Alertmanager service %s/%s not found.\n", self.namespace, self.name)
+		}
+		return
+	}
+	if reflect.DeepEqual(url, previous) {
+		return
+	}
+	log.Printf("Discovered Alertmanager %v.\n", url)
+	self.onChange()
+}
+
+// discover returns the URLs of the Alertmanager, falling back to its endpoints if
+// the service is headless.
+func (self *AlertmanagerDiscovery) discover() []string {
+	key := self.namespace + "/" + self.name
+	obj, exists, err := self.serviceStore.GetByKey(key)
+	if err != nil || !exists {
+		return nil
+	}
+	svc := obj.(*kapi.Service)
+	if !self.useEndpoints && svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != kapi.ClusterIPNone {
+		for _, port := range svc.Spec.Ports {
+			if self.portName == "" || port.Name == self.portName {
+				return []string{alertmanagerURL(svc.Spec.ClusterIP, port.Port)}
+			}
+		}
+		log.Printf("Alertmanager service %s has no port named %q.\n", key, self.portName)
+		return nil
+	}
+
+	obj, exists, err = self.endpointsStore.GetByKey(key)
+	if err != nil || !exists {
+		return nil
+	}
+	var urls []string
+	for _, subset := range obj.(*kapi.Endpoints).Subsets {
+		for _, port := range subset.Ports {
+			if self.portName != "" && port.Name != self.portName {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				urls = append(urls, alertmanagerURL(address.IP, port.Port))
+			}
+			break
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+func alertmanagerURL(host string, port int) string {
+	return fmt.Sprintf("http://%s:%d/", host, port)
+}
+
+// loaderNamespace returns the namespace the loader runs in, falling back to default.
+func loaderNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	if data, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return kapi.NamespaceDefault
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+)
+
+func TestAlertmanagerDiscoveryKeepsURL(t *testing.T) {
+	changes := 0
+	discovery := &AlertmanagerDiscovery{
+		namespace:      "monitoring",
+		name:           "alertmanager",
+		onChange:       func() { changes++ },
+		serviceStore:   kcache.NewStore(kcache.MetaNamespaceKeyFunc),
+		endpointsStore: kcache.NewStore(kcache.MetaNamespaceKeyFunc),
+		mutex:          &sync.Mutex{},
+	}
+	service := &kapi.Service{
+		ObjectMeta: kapi.ObjectMeta{Name: "alertmanager", Namespace: "monitoring"},
+		Spec:       kapi.ServiceSpec{ClusterIP: "10.0.0.1", Ports: []kapi.ServicePort{{Port: 9093}}},
+	}
+
+	steps := []struct {
+		desc    string
+		service *kapi.Service
+		url     interface{}
+		changes int
+	}{
+		{"not created yet", nil, nil, 0},
+		{"created", service, "http://10.0.0.1:9093/", 1},
+		{"deleted", nil, "http://10.0.0.1:9093/", 1},
+		{"created again", service, "http://10.0.0.1:9093/", 1},
+	}
+
+	for _, step := range steps {
+		if step.service != nil {
+			discovery.serviceStore.Add(step.service)
+		} else {
+			discovery.serviceStore.Delete(service)
+		}
+		discovery.update()
+		if url := discovery.URL(); !reflect.DeepEqual(url, step.url) {
+			t.Errorf("%s: got URL %v, expected %v", step.desc, url, step.url)
+		}
+		if changes != step.changes {
+			t.Errorf("%s: rules were re-rendered %d times, expected %d", step.desc, changes, step.changes)
+		}
+	}
+}
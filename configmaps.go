@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+/*
+ Provides the rules found in the mounted ConfigMap directory. The whole directory is
+ re-read whenever the source is marked dirty.
+*/
+type ConfigMapMountSource struct {
+	configMapLocation string
+	renderer          *RuleRenderer
+	notify            func()
+	mutex             *sync.Mutex
+	dirty             bool
+}
+
+// NewConfigMapMountSource creates the source. notify requests a sync, to retry one
+// that failed.
+func NewConfigMapMountSource(configMapLocation string, renderer *RuleRenderer, notify func()) *ConfigMapMountSource {
+	return &ConfigMapMountSource{
+		configMapLocation: configMapLocation,
+		renderer:          renderer,
+		notify:            notify,
+		mutex:             &sync.Mutex{},
+		dirty:             true,
+	}
+}
+
+func (self *ConfigMapMountSource) Resync() {
+	self.mutex.Lock()
+	self.dirty = true
+	self.mutex.Unlock()
+}
+
+func (self *ConfigMapMountSource) Sync(s *ruleSync) {
+	self.mutex.Lock()
+	dirty := self.dirty
+	self.dirty = false
+	self.mutex.Unlock()
+	if !dirty {
+		return
+	}
+
+	if err := s.reconcile(ownsKind(sourceConfigMapMount), rulesFromConfigMapMount(self.configMapLocation, self.renderer.begin())); err != nil {
+		log.Printf("Unable to sync ConfigMap rules. Error: %s\n", err)
+		self.Resync()
+		time.AfterFunc(syncRetryDelay, self.notify)
+	}
+}
+
+func rulesFromConfigMapMount(configMapLocation string, pass *renderPass) []elastalertRule {
+	log.Println("Processing ConfigMap rules.")
+	fileList := GatherFilesFromConfigmap(configMapLocation)
+
+	var ruleList []elastalertRule
+	for _, file := range fileList {
+		key, err := filepath.Rel(configMapLocation, file)
+		if err != nil {
+			key = filepath.Base(file)
+		}
+		rules, err := processRuleFile(file, pass, templateContext{Kind: "ConfigMap", Name: key})
+		if os.IsNotExist(err) {
+			// the key was removed after the walk, so its rules go like those of any removed key
+			log.Printf("ConfigMap file %s was removed while syncing, skipping it.\n", file)
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			rulesRejected.WithLabelValues(sourceConfigMapMount, "").Inc()
+			continue
+		}
+		for _, rule := range rules {
+			rule.origin = ruleOrigin{Kind: sourceConfigMapMount, Name: key}
+			ruleList = append(ruleList, rule)
+		}
+	}
+	return ruleList
+}
+
+/*
+ Reads rules from the ConfigMaps matching a label selector, in any namespace. Every
+ data key holds a rule file, so removing a key or the ConfigMap removes its rules.
+*/
+func configMapKind(kubeClient *kclient.Client, selector labels.Selector) *objectKind {
+	return &objectKind{
+		source:     sourceConfigMap,
+		kind:       "ConfigMap",
+		apiVersion: "v1",
+		resource:   "configmaps",
+		client:     kubeClient.RESTClient,
+		selector:   selector,
+		newObject:  func() runtime.Object { return &kapi.ConfigMap{} },
+		document:   "key",
+		documents: func(obj runtime.Object) map[string]string {
+			return obj.(*kapi.ConfigMap).Data
+		},
+	}
+}
+
+func GatherFilesFromConfigmap(configMapLocation string) []string {
+	fileList := []string{}
+	err := filepath.Walk(configMapLocation, func(path string, f os.FileInfo, err error) error {
+		// ConfigMap keys are symlinks, so they are stat'ed rather than taken from the walk
+		stat, err := os.Stat(path)
+		if err != nil {
+			// e.g. a file that went away while the ConfigMap was updated
+			log.Printf("Cannot stat %s, %s\n", path, err)
+			return nil
+		}
+		if !stat.IsDir() {
+			// ignore the configmap /..dirname directories
+			if !(strings.Contains(path, "/..")) {
+				fileList = append(fileList, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// not sure what I might see here, so making this fatal for now
+		log.Printf("Cannot process path: %s, %s\n", configMapLocation, err)
+	}
+	return fileList
+}
+
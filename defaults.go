@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ Options merged into every rule. Defaults fill in the options a rule leaves out and
+ forced options override whatever the rule says; nested maps are merged key by key
+ in both cases, except time periods, which are replaced whole. Profiles layer more
+ options on top for the namespaces they select.
+*/
+type RuleDefaults struct {
+	Defaults map[string]interface{} `yaml:"defaults"`
+	Force    map[string]interface{} `yaml:"force"`
+	Profiles []defaultsProfile      `yaml:"profiles"`
+}
+
+/*
+ Defaults and forced options for the namespaces matched by name, by a path.Match
+ pattern such as team-*, or by all of the given labels or all of the given
+ annotations.
+*/
+type defaultsProfile struct {
+	Name                 string                 `yaml:"name"`
+	Namespaces           []string               `yaml:"namespaces"`
+	NamespaceLabels      map[string]string      `yaml:"namespaceLabels"`
+	NamespaceAnnotations map[string]string      `yaml:"namespaceAnnotations"`
+	Defaults             map[string]interface{} `yaml:"defaults"`
+	Force                map[string]interface{} `yaml:"force"`
+}
+
+func (self defaultsProfile) matches(namespace string, labels, annotations map[string]string) bool {
+	for _, pattern := range self.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return (len(self.NamespaceLabels) > 0 && containsAll(labels, self.NamespaceLabels)) ||
+		(len(self.NamespaceAnnotations) > 0 && containsAll(annotations, self.NamespaceAnnotations))
+}
+
+func containsAll(m, subset map[string]string) bool {
+	for key, value := range subset {
+		if actual, ok := m[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// builtinRuleDefaults are the defaults used when no defaults file is given.
+func builtinRuleDefaults() *RuleDefaults {
+	defaults := &RuleDefaults{
+		Defaults: map[string]interface{}{
+			"index":                 "*",
+			"alert":                 prometheusAlerter,
+			"use_kibana4_dashboard": "/_plugin/kibana/#/dashboard",
+			"aws_region":            os.Getenv("ELASTICSEARCH_AWS_REGION"),
+		},
+	}
+	// otherwise the Alertmanager is discovered through the API
+	if *alertmanagerService == "" {
+		defaults.Defaults["alertmanager_url"] = fmt.Sprintf("http://%s:%s/", os.Getenv("ALERTMANAGER_SERVICE_HOST"), os.Getenv("ALERTMANAGER_SERVICE_PORT"))
+	}
+	return defaults
+}
+
+// withDefault adds a default for an option, unless the defaults already have one.
+func (self *RuleDefaults) withDefault(option string, value interface{}) *RuleDefaults {
+	if _, ok := self.Defaults[option]; ok {
+		return self
+	}
+	copied := *self
+	copied.Defaults = make(map[string]interface{}, len(self.Defaults)+1)
+	for key, value := range self.Defaults {
+		copied.Defaults[key] = value
+	}
+	copied.Defaults[option] = value
+	return &copied
+}
+
+/*
+ Reads a defaults file, a YAML map with defaults and force sections that each hold
+ rule options, and a list of namespace profiles with their own defaults and force
+ sections. ${VAR} in string values is replaced with the environment variable VAR.
+*/
+func loadRuleDefaults(file string) (*RuleDefaults, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections map[string]interface{}
+	if err := yaml.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+	for key := range sections {
+		if key != "defaults" && key != "force" && key != "profiles" {
+			return nil, fmt.Errorf("Unknown section %q, expected defaults, force or profiles", key)
+		}
+	}
+
+	defaults := &RuleDefaults{}
+	if err := yaml.Unmarshal(data, defaults); err != nil {
+		return nil, err
+	}
+	if err := checkDefaultOptions("defaults", defaults.Defaults); err != nil {
+		return nil, err
+	}
+	if err := checkDefaultOptions("force", defaults.Force); err != nil {
+		return nil, err
+	}
+
+	for i := range defaults.Profiles {
+		profile := &defaults.Profiles[i]
+		if profile.Name == "" {
+			profile.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if len(profile.Namespaces) == 0 && len(profile.NamespaceLabels) == 0 && len(profile.NamespaceAnnotations) == 0 {
+			return nil, fmt.Errorf("Profile %s selects no namespaces", profile.Name)
+		}
+		for _, pattern := range profile.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Profile %s: invalid namespace pattern %q", profile.Name, pattern)
+			}
+		}
+		if err := checkDefaultOptions("profile "+profile.Name+" defaults", profile.Defaults); err != nil {
+			return nil, err
+		}
+		if err := checkDefaultOptions("profile "+profile.Name+" force", profile.Force); err != nil {
+			return nil, err
+		}
+	}
+	return defaults, nil
+}
+
+// checkDefaultOptions expands the environment variables in a section of rule options.
+func checkDefaultOptions(section string, options map[string]interface{}) error {
+	for name, option := range options {
+		if name == "name" {
+			return fmt.Errorf("Section %s: the rule name cannot be defaulted", section)
+		}
+		options[name] = expandEnv(option)
+	}
+	return nil
+}
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} references in every string of a YAML value.
+func expandEnv(value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(value, func(ref string) string {
+			return os.Getenv(ref[2 : len(ref)-1])
+		})
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = expandEnv(item)
+		}
+		return list
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(value))
+		for k, item := range value {
+			m[k] = expandEnv(item)
+		}
+		return m
+	}
+	return value
+}
+
+/*
+ Layers the profiles that select a namespace over the global defaults, in the order
+ they appear in the defaults file. The options of a profile win over the global
+ options and those of earlier profiles.
+*/
+func (self *RuleDefaults) forNamespace(namespace string, labels, annotations map[string]string) *RuleDefaults {
+	if self == nil {
+		return nil
+	}
+
+	layered := self
+	for _, profile := range self.Profiles {
+		if !profile.matches(namespace, labels, annotations) {
+			continue
+		}
+		if layered == self {
+			layered = &RuleDefaults{Defaults: copyOptions(self.Defaults), Force: copyOptions(self.Force)}
+		}
+		overlayOptions(layered.Defaults, profile.Defaults)
+		overlayOptions(layered.Force, profile.Force)
+	}
+	return layered
+}
+
+// apply merges the defaults and forced options into a rule.
+func (self *RuleDefaults) apply(ruleMap map[string]interface{}) {
+	if self == nil {
+		return
+	}
+	for key, value := range self.Defaults {
+		if existing, ok := ruleMap[key]; ok {
+			ruleMap[key] = mergeRuleOption(key, existing, value, false)
+		} else {
+			ruleMap[key] = copyOption(value)
+		}
+	}
+	overlayOptions(ruleMap, self.Force)
+}
+
+// overlayOptions merges options into options, the new ones winning.
+func overlayOptions(options, top map[string]interface{}) {
+	for key, value := range top {
+		if existing, ok := options[key]; ok {
+			options[key] = mergeRuleOption(key, existing, value, true)
+		} else {
+			options[key] = copyOption(value)
+		}
+	}
+}
+
+// mergeRuleOption merges a default into the option key of a rule. Time periods are
+// replaced whole, as merging {minutes: 5} into {hours: 1} would add them up.
+func mergeRuleOption(key string, value, def interface{}, force bool) interface{} {
+	if isTimeframeOption(key) {
+		if force {
+			return copyOption(def)
+		}
+		return value
+	}
+	return mergeOption(value, def, force)
+}
+
+// mergeOption merges a default into an option of a rule. Maps are merged key by key;
+// any other value of the rule wins unless force is set.
+func mergeOption(value, def interface{}, force bool) interface{} {
+	m, ok := value.(map[interface{}]interface{})
+	defMap, defOk := def.(map[interface{}]interface{})
+	if !ok || !defOk {
+		if force {
+			return copyOption(def)
+		}
+		return value
+	}
+
+	for key, defValue := range defMap {
+		if existing, ok := m[key]; ok {
+			m[key] = mergeOption(existing, defValue, force)
+		} else {
+			m[key] = copyOption(defValue)
+		}
+	}
+	return m
+}
+
+func copyOptions(options map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(options))
+	for key, value := range options {
+		copied[key] = copyOption(value)
+	}
+	return copied
+}
+
+// copyOption deep copies a default, so rules never share maps or lists.
+func copyOption(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = copyOption(item)
+		}
+		return list
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(value))
+		for k, item := range value {
+			m[k] = copyOption(item)
+		}
+		return m
+	}
+	return value
+}
+
+/*
+ Holds the current rule defaults. The defaults file is re-read on Reload, and a file
+ that fails to load leaves the previous defaults in place.
+*/
+type DefaultsManager struct {
+	path     string
+	mutex    *sync.Mutex
+	defaults *RuleDefaults
+}
+
+// NewDefaultsManager loads the defaults file, or the built-in defaults if path is empty.
+func NewDefaultsManager(path string) (*DefaultsManager, error) {
+	manager := &DefaultsManager{path: path, mutex: &sync.Mutex{}, defaults: builtinRuleDefaults()}
+	if path == "" {
+		return manager, nil
+	}
+	if err := manager.Reload(); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+func (self *DefaultsManager) Get() *RuleDefaults {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.defaults
+}
+
+func (self *DefaultsManager) Reload() error {
+	if self.path == "" {
+		return nil
+	}
+	defaults, err := loadRuleDefaults(self.path)
+	if err != nil {
+		return fmt.Errorf("Unable to load rule defaults from %s. Error: %s", self.path, err)
+	}
+	log.Printf("Loaded rule defaults from %s.\n", self.path)
+
+	self.mutex.Lock()
+	self.defaults = defaults
+	self.mutex.Unlock()
+	return nil
+}
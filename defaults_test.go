@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRuleDefaultsApply(t *testing.T) {
+	tests := []struct {
+		desc     string
+		defaults string
+		rule     string
+		expected string
+	}{
+		{
+			"forced time period replaces the rule's",
+			"force: {realert: {minutes: 5}}",
+			"realert: {hours: 1}",
+			"realert: {minutes: 5}",
+		},
+		{
+			"default time period leaves the rule's alone",
+			"defaults: {timeframe: {minutes: 5}, realert: {minutes: 1}}",
+			"timeframe: {hours: 1}",
+			"timeframe: {hours: 1}\nrealert: {minutes: 1}",
+		},
+		{
+			"other maps are merged",
+			"defaults: {filter_options: {a: 1, b: 2}}\nforce: {labels: {team: ops}}",
+			"filter_options: {b: 3}\nlabels: {team: dev, env: prod}",
+			"filter_options: {a: 1, b: 3}\nlabels: {team: ops, env: prod}",
+		},
+	}
+
+	for _, test := range tests {
+		var defaults RuleDefaults
+		var rule, expected map[string]interface{}
+		for _, doc := range []struct {
+			data string
+			into interface{}
+		}{{test.defaults, &defaults}, {test.rule, &rule}, {test.expected, &expected}} {
+			if err := yaml.Unmarshal([]byte(doc.data), doc.into); err != nil {
+				t.Fatalf("%s: %s", test.desc, err)
+			}
+		}
+
+		defaults.apply(rule)
+		if !reflect.DeepEqual(rule, expected) {
+			t.Errorf("%s: got %v, expected %v", test.desc, rule, expected)
+		}
+	}
+}
+
+func TestRuleDefaultsProfileTimeframe(t *testing.T) {
+	var defaults RuleDefaults
+	data := "defaults: {realert: {hours: 1}}\nprofiles: [{namespaces: [team-*], defaults: {realert: {minutes: 5}}}]"
+	if err := yaml.Unmarshal([]byte(data), &defaults); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := map[string]interface{}{}
+	defaults.forNamespace("team-a", nil, nil).apply(rule)
+	expected := map[interface{}]interface{}{"minutes": 5}
+	if !reflect.DeepEqual(rule["realert"], expected) {
+		t.Errorf("Got realert %v, expected %v", rule["realert"], expected)
+	}
+}
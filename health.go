@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ Tracks the informers whose list and watch requests keep failing. An informer counts
+ as disconnected from its first failure until a request of its own succeeds again.
+*/
+type watchHealth struct {
+	mutex    *sync.Mutex
+	failures map[string]time.Time
+}
+
+// Fed by every instrumented list watch.
+var apiWatchHealth = &watchHealth{mutex: &sync.Mutex{}, failures: map[string]time.Time{}}
+
+func (self *watchHealth) failed(informer string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if _, ok := self.failures[informer]; !ok {
+		self.failures[informer] = time.Now()
+	}
+}
+
+func (self *watchHealth) succeeded(informer string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.failures, informer)
+}
+
+// disconnected returns the informers that have been failing for longer than timeout.
+func (self *watchHealth) disconnected(timeout time.Duration, now time.Time) []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var informers []string
+	for informer, since := range self.failures {
+		if now.Sub(since) > timeout {
+			informers = append(informers, informer)
+		}
+	}
+	sort.Strings(informers)
+	return informers
+}
+
+/*
+ Backs the liveness and readiness endpoints. The loader is ready once a sync that
+ covered the initial contents of every source succeeded. It is alive as long as a
+ sync succeeded within the sync window, counted from startup until the first one,
+ and no informer has been disconnected for longer than the watch timeout.
+*/
+type HealthChecker struct {
+	syncWindow   time.Duration
+	watchTimeout time.Duration
+	watches      *watchHealth
+
+	mutex    *sync.Mutex
+	started  time.Time
+	lastSync time.Time
+	ready    bool
+}
+
+func NewHealthChecker(syncWindow, watchTimeout time.Duration) *HealthChecker {
+	return &HealthChecker{
+		syncWindow:   syncWindow,
+		watchTimeout: watchTimeout,
+		watches:      apiWatchHealth,
+		mutex:        &sync.Mutex{},
+		started:      time.Now(),
+	}
+}
+
+// Synced records a successful sync. initial is set if every source had its
+// initial contents by the time the sync started.
+func (self *HealthChecker) Synced(initial bool) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.lastSync = time.Now()
+	self.ready = self.ready || initial
+}
+
+// Live returns why the loader is wedged, or nil.
+func (self *HealthChecker) Live() error {
+	now := time.Now()
+	self.mutex.Lock()
+	since := self.lastSync
+	if since.IsZero() {
+		since = self.started
+	}
+	self.mutex.Unlock()
+
+	if now.Sub(since) > self.syncWindow {
+		return fmt.Errorf("No successful sync since %s", since.UTC().Format(time.RFC3339))
+	}
+	if informers := self.watches.disconnected(self.watchTimeout, now); len(informers) > 0 {
+		return fmt.Errorf("Watches disconnected for more than %s: %v", self.watchTimeout, informers)
+	}
+	return nil
+}
+
+// Ready returns why the loader is not ready yet, or nil.
+func (self *HealthChecker) Ready() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.ready {
+		return fmt.Errorf("Initial sync has not completed")
+	}
+	return nil
+}
+
+func (self *HealthChecker) ServeLive(w http.ResponseWriter, r *http.Request) {
+	serveCheck(w, self.Live(), http.StatusInternalServerError)
+}
+
+func (self *HealthChecker) ServeReady(w http.ResponseWriter, r *http.Request) {
+	serveCheck(w, self.Ready(), http.StatusServiceUnavailable)
+}
+
+func serveCheck(w http.ResponseWriter, err error, failureCode int) {
+	if err != nil {
+		http.Error(w, err.Error(), failureCode)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// listWatchResult returns a list watch whose lists fail with err, or succeed if err is nil.
+func listWatchResult(err error) *kcache.ListWatch {
+	return &kcache.ListWatch{
+		ListFunc: func(options kapi.ListOptions) (runtime.Object, error) {
+			if err != nil {
+				return nil, err
+			}
+			return &kapi.ServiceList{}, nil
+		},
+	}
+}
+
+func TestWatchHealthKeyedByInformer(t *testing.T) {
+	defer func() {
+		apiWatchHealth.succeeded("services")
+		apiWatchHealth.succeeded("services in monitoring")
+	}()
+
+	// the services of every namespace keep failing, the Alertmanager service does not
+	rules := instrumentListWatch("services", kapi.NamespaceAll, listWatchResult(errors.New("forbidden")))
+	alertmanager := instrumentListWatch("services", "monitoring", listWatchResult(nil))
+	rules.List(kapi.ListOptions{})
+	alertmanager.List(kapi.ListOptions{})
+
+	later := time.Now().Add(time.Hour)
+	if disconnected := apiWatchHealth.disconnected(time.Minute, later); !reflect.DeepEqual(disconnected, []string{"services"}) {
+		t.Errorf("Got disconnected informers %v, expected [services]", disconnected)
+	}
+
+	rules = instrumentListWatch("services", kapi.NamespaceAll, listWatchResult(nil))
+	rules.List(kapi.ListOptions{})
+	if disconnected := apiWatchHealth.disconnected(time.Minute, later); len(disconnected) != 0 {
+		t.Errorf("Got disconnected informers %v after they recovered", disconnected)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+
+	"k8s.io/kubernetes/pkg/client/restclient"
+)
+
+/*
+ The parts of a kubeconfig file the loader understands: clusters, users with a
+ token, basic auth or client certificate, and the contexts pairing them. Auth
+ provider plugins are not supported.
+*/
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+/*
+ Returns the configuration of the API client. Without a kubeconfig file the loader
+ runs in-cluster, or talks to master without credentials if one is given. master
+ overrides the server of the kubeconfig context.
+*/
+func clientConfig(kubeconfigFile, context, master string) (*restclient.Config, error) {
+	if kubeconfigFile == "" {
+		if context != "" {
+			return nil, fmt.Errorf("A context requires a kubeconfig file")
+		}
+		if master != "" {
+			return &restclient.Config{Host: master}, nil
+		}
+		return restclient.InClusterConfig()
+	}
+
+	config, err := loadKubeconfig(kubeconfigFile, context)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load kubeconfig %s. Error: %s", kubeconfigFile, err)
+	}
+	if master != "" {
+		config.Host = master
+	}
+	return config, nil
+}
+
+// loadKubeconfig builds the client configuration of a context, or of the current
+// context if context is empty.
+func loadKubeconfig(file, context string) (*restclient.Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kc := &kubeconfig{}
+	if err := yaml.Unmarshal(data, kc); err != nil {
+		return nil, err
+	}
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	if context == "" {
+		return nil, fmt.Errorf("No context given and no current context set")
+	}
+
+	// relative paths in a kubeconfig are relative to the file
+	dir := filepath.Dir(file)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	config := &restclient.Config{}
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name != context {
+			continue
+		}
+		found = true
+
+		clusterFound := false
+		for _, cluster := range kc.Clusters {
+			if cluster.Name != c.Context.Cluster {
+				continue
+			}
+			clusterFound = true
+			config.Host = cluster.Cluster.Server
+			config.Insecure = cluster.Cluster.InsecureSkipTLSVerify
+			config.CAFile = resolve(cluster.Cluster.CertificateAuthority)
+			if config.CAData, err = decodeKubeconfigData(cluster.Cluster.CertificateAuthorityData); err != nil {
+				return nil, fmt.Errorf("Cluster %s: invalid certificate-authority-data: %s", cluster.Name, err)
+			}
+		}
+		if !clusterFound {
+			return nil, fmt.Errorf("Context %s refers to unknown cluster %q", context, c.Context.Cluster)
+		}
+
+		for _, user := range kc.Users {
+			if c.Context.User == "" || user.Name != c.Context.User {
+				continue
+			}
+			config.BearerToken = user.User.Token
+			config.Username = user.User.Username
+			config.Password = user.User.Password
+			config.CertFile = resolve(user.User.ClientCertificate)
+			config.KeyFile = resolve(user.User.ClientKey)
+			if config.CertData, err = decodeKubeconfigData(user.User.ClientCertificateData); err != nil {
+				return nil, fmt.Errorf("User %s: invalid client-certificate-data: %s", user.Name, err)
+			}
+			if config.KeyData, err = decodeKubeconfigData(user.User.ClientKeyData); err != nil {
+				return nil, fmt.Errorf("User %s: invalid client-key-data: %s", user.Name, err)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown context %q", context)
+	}
+	if config.Host == "" {
+		return nil, fmt.Errorf("Context %s has no server", context)
+	}
+	return config, nil
+}
+
+func decodeKubeconfigData(data string) ([]byte, error) {
+	if data == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
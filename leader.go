@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// Annotation holding the leader election record, the same one Kubernetes components use.
+const leaderAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+// The lease held by the leader, written as JSON into the leader annotation of the lock object.
+type leaderElectionRecord struct {
+	HolderIdentity       string           `json:"holderIdentity"`
+	LeaseDurationSeconds int              `json:"leaseDurationSeconds"`
+	AcquireTime          unversioned.Time `json:"acquireTime"`
+	RenewTime            unversioned.Time `json:"renewTime"`
+	LeaderTransitions    int              `json:"leaderTransitions"`
+}
+
+/*
+ Elects a single leader among the loader replicas through a lease held in an
+ annotation of an Endpoints or ConfigMap object. A lease is taken over once its
+ holder has not renewed it for the lease duration, as observed by the clock of the
+ candidate, and the leader steps down when it could not renew its lease within the
+ renew deadline.
+*/
+type LeaderElector struct {
+	lock          *objectKind
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	observed     leaderElectionRecord
+	observedTime time.Time
+
+	mutex   *sync.Mutex
+	leading bool
+}
+
+// NewLeaderElector creates an elector using an endpoints or configmaps object as the lock.
+func NewLeaderElector(kubeClient *kclient.Client, lockResource, namespace, name, identity string, leaseDuration, renewDeadline, retryPeriod time.Duration) (*LeaderElector, error) {
+	lock := &objectKind{resource: lockResource, client: kubeClient.RESTClient}
+	switch lockResource {
+	case "endpoints":
+		lock.newObject = func() runtime.Object { return &kapi.Endpoints{} }
+	case "configmaps":
+		lock.newObject = func() runtime.Object { return &kapi.ConfigMap{} }
+	default:
+		return nil, fmt.Errorf("Unsupported lock resource %q, expected endpoints or configmaps", lockResource)
+	}
+	if identity == "" {
+		return nil, fmt.Errorf("Leader election requires an identity")
+	}
+	if renewDeadline >= leaseDuration {
+		return nil, fmt.Errorf("The renew deadline must be shorter than the lease duration")
+	}
+
+	return &LeaderElector{
+		lock:          lock,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: renewDeadline,
+		retryPeriod:   retryPeriod,
+		mutex:         &sync.Mutex{},
+	}, nil
+}
+
+// IsLeader reports whether this replica holds the lease. Without an elector every
+// replica leads.
+func (self *LeaderElector) IsLeader() bool {
+	if self == nil {
+		return true
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.leading
+}
+
+/*
+ Campaigns for the lease until stopCh closes, calling onStartedLeading every time
+ this replica becomes the leader. A leader that loses its lease goes back to
+ campaigning.
+*/
+func (self *LeaderElector) Run(stopCh <-chan struct{}, onStartedLeading func()) {
+	for {
+		for !self.tryAcquireOrRenew() {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(self.retryPeriod):
+			}
+		}
+		log.Printf("Became the leader as %s.\n", self.identity)
+		self.setLeading(true)
+		onStartedLeading()
+
+		renewed := time.Now()
+		for time.Since(renewed) < self.renewDeadline {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(self.retryPeriod):
+			}
+			if self.tryAcquireOrRenew() {
+				renewed = time.Now()
+			}
+		}
+		log.Printf("Lost the lease, no longer the leader.\n")
+		self.setLeading(false)
+	}
+}
+
+func (self *LeaderElector) setLeading(leading bool) {
+	self.mutex.Lock()
+	self.leading = leading
+	self.mutex.Unlock()
+}
+
+// tryAcquireOrRenew takes or renews the lease, and reports whether this replica holds it.
+func (self *LeaderElector) tryAcquireOrRenew() bool {
+	now := unversioned.Now()
+	record := leaderElectionRecord{
+		HolderIdentity:       self.identity,
+		LeaseDurationSeconds: int(self.leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	obj := self.lock.newObject()
+	err := self.lock.client.Get().Namespace(self.namespace).Resource(self.lock.resource).Name(self.name).Do().Into(obj)
+	if kerrors.IsNotFound(err) {
+		if err := self.write(self.lock.newObject(), record, true); err != nil {
+			log.Printf("Unable to create leader lock %s/%s. Error: %s\n", self.namespace, self.name, err)
+			return false
+		}
+		self.observe(record)
+		return true
+	}
+	if err != nil {
+		log.Printf("Unable to read leader lock %s/%s. Error: %s\n", self.namespace, self.name, err)
+		return false
+	}
+
+	var current leaderElectionRecord
+	if value := objectMeta(obj).GetAnnotations()[leaderAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			log.Printf("Unable to read leader election record of %s/%s, taking it over. Error: %s\n", self.namespace, self.name, err)
+		}
+	}
+	if !reflect.DeepEqual(current, self.observed) {
+		self.observe(current)
+	}
+	if current.HolderIdentity != "" && current.HolderIdentity != self.identity && self.observedTime.Add(self.leaseDuration).After(now.Time) {
+		return false
+	}
+
+	if current.HolderIdentity == self.identity {
+		record.AcquireTime = current.AcquireTime
+		record.LeaderTransitions = current.LeaderTransitions
+	} else {
+		record.LeaderTransitions = current.LeaderTransitions + 1
+	}
+	if err := self.write(obj, record, false); err != nil {
+		if !kerrors.IsConflict(err) {
+			log.Printf("Unable to update leader lock %s/%s. Error: %s\n", self.namespace, self.name, err)
+		}
+		return false
+	}
+	self.observe(record)
+	return true
+}
+
+// write stores a record in the lock object, creating the object if create is set.
+func (self *LeaderElector) write(obj runtime.Object, record leaderElectionRecord, create bool) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	m := objectMeta(obj)
+	annotations := m.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[leaderAnnotation] = string(data)
+	m.SetAnnotations(annotations)
+
+	if create {
+		m.SetNamespace(self.namespace)
+		m.SetName(self.name)
+		return self.lock.client.Post().Namespace(self.namespace).Resource(self.lock.resource).Body(obj).Do().Error()
+	}
+	return self.lock.client.Put().Namespace(self.namespace).Resource(self.lock.resource).Name(self.name).Body(obj).Do().Error()
+}
+
+func (self *LeaderElector) observe(record leaderElectionRecord) {
+	self.observed = record
+	self.observedTime = time.Now()
+}
@@ -1,39 +1,76 @@
 package main //import "github.com/nordstrom/elastalertRuleLoader"
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
 
-	kapi "k8s.io/kubernetes/pkg/api"
-	kcache "k8s.io/kubernetes/pkg/client/cache"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
-	kframework "k8s.io/kubernetes/pkg/controller/framework"
-	kselector "k8s.io/kubernetes/pkg/fields"
-	klabels "k8s.io/kubernetes/pkg/labels"
-	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/labels"
 )
 
 var (
 	// FLAGS
-	configMapLocation = flag.String("configMapLocation", os.Getenv("CONFIG_MAP_DIRECTORY"), "Location of the config map mount.")
-	rulesLocation     = flag.String("rulesDirectory", os.Getenv("RULES_DIRECTORY"), "Path where the rules that come from the services should be written.")
-	helpFlag          = flag.Bool("help", false, "")
-	annotationKey     = flag.String("annotationKey", "nordstrom.net/elastalertAlerts", "Annotation key for elastalert rules")
+	configMapLocation       = flag.String("configMapLocation", os.Getenv("CONFIG_MAP_DIRECTORY"), "Location of the config map mount.")
+	rulesLocation           = flag.String("rulesDirectory", os.Getenv("RULES_DIRECTORY"), "Path where the rules that come from the services should be written.")
+	helpFlag                = flag.Bool("help", false, "")
+	annotationKey           = flag.String("annotationKey", "nordstrom.net/elastalertAlerts", "Annotation key for elastalert rules")
+	annotationPrefix        = flag.String("annotationPrefix", "nordstrom.net/elastalertAlerts.", "Annotation key prefix for elastalert rules, each annotation starting with it holds more rules")
+	stagedWrites            = flag.Bool("stagedWrites", false, "Stage each sync into a new directory and swap it in by replacing the rules directory symlink.")
+	syncQuietPeriod         = flag.Duration("syncQuietPeriod", 2*time.Second, "How long rule sources must be quiet before a sync runs.")
+	syncMaxDelay            = flag.Duration("syncMaxDelay", 30*time.Second, "Longest a sync is delayed by rule sources that keep changing.")
+	defaultsFile            = flag.String("defaultsFile", os.Getenv("DEFAULTS_FILE"), "YAML file with the defaults and forced options of every rule, re-read when it changes. Built-in defaults are used if empty.")
+	templateLibrary         = flag.String("templateLibrary", os.Getenv("TEMPLATE_LIBRARY_DIRECTORY"), "Directory of rule templates that rules can reference by name, re-read when it changes.")
+	renderTemplates         = flag.Bool("templates", false, "Render rule annotations and ConfigMap rules as Go templates with the context of the object they come from.")
+	clusterName             = flag.String("clusterName", os.Getenv("CLUSTER_NAME"), "Name of the cluster, available to rule templates as .ClusterName.")
+	alertmanagerService     = flag.String("alertmanagerService", "alertmanager", "Name of the Alertmanager service to discover the default alertmanager_url from. If empty, ALERTMANAGER_SERVICE_HOST and ALERTMANAGER_SERVICE_PORT are used.")
+	alertmanagerNamespace   = flag.String("alertmanagerNamespace", loaderNamespace(), "Namespace of the Alertmanager service.")
+	alertmanagerPort        = flag.String("alertmanagerPort", "", "Name of the Alertmanager service port. The first port is used if empty.")
+	alertmanagerEndpoints   = flag.Bool("alertmanagerEndpoints", false, "Set alertmanager_url to the list of every ready Alertmanager replica rather than the service IP.")
+	statusAnnotationKey     = flag.String("statusAnnotationKey", "nordstrom.net/elastalertAlertsStatus", "Annotation key the rule status of an object is written to. Empty disables status annotations and events.")
+	annotatedResources      = flag.String("annotatedResources", "services,deployments,replicasets,daemonsets,jobs,ingresses", "Comma separated resources whose rule annotations are loaded, out of services, deployments, replicasets, daemonsets, jobs and ingresses.")
+	ruleResources           = flag.Bool("ruleResources", false, "Load rules from ElastalertRule resources (nordstrom.net/v1), which must be registered as a ThirdPartyResource or CustomResourceDefinition.")
+	kubeconfigFile          = flag.String("kubeconfig", "", "Path to a kubeconfig file, to run outside of a cluster. Rule status, events and leader election are then disabled.")
+	kubeContext             = flag.String("context", "", "Context of the kubeconfig file to use. The current context is used if empty.")
+	master                  = flag.String("master", "", "Address of the API server, overriding the kubeconfig file. Without a kubeconfig file it is used without credentials.")
+	shutdownTimeout         = flag.Duration("shutdownTimeout", 25*time.Second, "How long to wait for the sync in flight and pending status updates on SIGTERM or SIGINT.")
+	leaderElect             = flag.Bool("leaderElect", false, "Elect a leader among the loader replicas; only the leader writes rules and status, the others keep their caches warm and take over when the lease is lost.")
+	leaderElectionLock      = flag.String("leaderElectionLock", "configmaps", "Resource holding the leader lease, endpoints or configmaps.")
+	leaderElectionName      = flag.String("leaderElectionName", "elastalert-rule-loader", "Name of the object holding the leader lease.")
+	leaderElectionNamespace = flag.String("leaderElectionNamespace", loaderNamespace(), "Namespace of the object holding the leader lease.")
+	leaseDuration           = flag.Duration("leaseDuration", 15*time.Second, "How long followers wait after the last renewal before taking over the leader lease.")
+	listenAddress           = flag.String("listenAddress", ":8080", "Address to serve Prometheus metrics (/metrics) and health checks (/healthz, /readyz) on. Empty disables it.")
+	livenessSyncWindow      = flag.Duration("livenessSyncWindow", time.Hour, "The loader is reported as not alive when no sync succeeded for this long.")
+	livenessWatchTimeout    = flag.Duration("livenessWatchTimeout", 5*time.Minute, "The loader is reported as not alive when the list and watch requests of an informer keep failing for this long.")
+	configMapSelector       = flag.String("configMapSelector", "elastalert-rules=true", "Label selector of the ConfigMaps, in any namespace, whose data keys hold rule files. Empty disables watching ConfigMaps.")
+	secretSelector          = flag.String("secretSelector", "elastalert-secrets=true", "Label selector a Secret must match before rules can refer to it with secretKeyRef. Empty lets rules read every Secret in their namespace.")
 )
 
 const (
 	// Resync period for the kube controller loop.
 	resyncPeriod = 30 * time.Minute
+	// Throttling and retry backoff for the service work queue.
+	queueQPS            = 10
+	queueBurst          = 100
+	queueInitialBackoff = time.Second
+	queueMaxBackoff     = 5 * time.Minute
+	// Delay before a failed sync is retried.
+	syncRetryDelay = 10 * time.Second
+	// Throttling of rule status updates.
+	statusQPS   = 5
+	statusBurst = 10
+	// Rule files holding values read from secrets are not readable by others.
+	secretRuleFileMode = 0640
 	// A subdomain added to the user specified domain for all services.
 	serviceSubdomain = "svc"
 	// A subdomain added to the user specified dmoain for all pods.
@@ -41,8 +78,11 @@ const (
 )
 
 type elastalertRule struct {
-	rule string
-	name string
+	rule   string
+	name   string
+	origin ruleOrigin
+	// the rule holds values read from secrets
+	secret bool
 }
 
 func main() {
@@ -57,236 +97,387 @@ func main() {
 	log.Printf("Config Map input path: %s\n", *configMapLocation)
 	log.Printf("Rules output path: %s\n", *rulesLocation)
 
-	// create client
-	var kubeClient *kclient.Client
-	kubeClient, err := kclient.NewInCluster()
+	// create client, in-cluster unless a kubeconfig or master is given
+	config, err := clientConfig(*kubeconfigFile, *kubeContext, *master)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
+	kubeClient, err := kclient.New(config)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	// a loader run from a workstation only previews rules, and must not write to the
+	// cluster or compete with the loader deployed in it
+	outOfCluster := *kubeconfigFile != "" || *master != ""
+	if outOfCluster {
+		log.Printf("Running outside of a cluster, rule status, events and leader election are disabled.\n")
+	}
 
-	// initial configmap rules pull.
-	updateConfigMapRules(*configMapLocation, *rulesLocation)
-
-	// initial service rules pull.
-	updateServiceRules(kubeClient, *rulesLocation)
-
-	// setup watcher for services
-	_ = watchForServices(kubeClient, func(interface{}) {
-		log.Printf("Services have updated.\n")
-		updateServiceRules(kubeClient, *rulesLocation)
-	})
-
-	// setup file watcher, will trigger whenever the configmap updates
-	watcher, err := WatchFile(*configMapLocation, time.Second, func() {
-		log.Printf("ConfigMap files updated.\n")
-		updateConfigMapRules(*configMapLocation, *rulesLocation)
-	})
+	defaults, err := NewDefaultsManager(*defaultsFile)
 	if err != nil {
-		log.Fatalf("Unable to watch ConfigMap: %s\n", err)
+		log.Fatalf("%s\n", err)
 	}
 
-	defer func() {
-		log.Printf("Cleaning up.")
-		watcher.Close()
+	var templates *TemplateLibrary
+	if *templateLibrary != "" {
+		if templates, err = NewTemplateLibrary(*templateLibrary); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+	}
+
+	// everything started below stops once a termination signal arrives
+	stopCh := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down.\n", sig)
+		close(stopCh)
 	}()
 
-	select {}
-}
+	health := NewHealthChecker(*livenessSyncWindow, *livenessWatchTimeout)
+	if *listenAddress != "" {
+		http.Handle("/metrics", prometheus.Handler())
+		http.HandleFunc("/healthz", health.ServeLive)
+		http.HandleFunc("/readyz", health.ServeReady)
+		go func() {
+			log.Fatalf("Unable to serve metrics: %s\n", http.ListenAndServe(*listenAddress, nil))
+		}()
+	}
 
-func createServiceLW(kubeClient *kclient.Client) *kcache.ListWatch {
-	return kcache.NewListWatchFromClient(kubeClient, "services", kapi.NamespaceAll, kselector.Everything())
-}
+	// with leader election only the leader writes, followers just keep their caches
+	var leader *LeaderElector
+	if *leaderElect && !outOfCluster {
+		identity, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Unable to get leader election identity: %s\n", err)
+		}
+		leader, err = NewLeaderElector(kubeClient, *leaderElectionLock, *leaderElectionNamespace, *leaderElectionName, identity, *leaseDuration, *leaseDuration*2/3, *leaseDuration/5)
+		if err != nil {
+			log.Fatalf("Invalid leader election settings: %s\n", err)
+		}
+	}
 
-func watchForServices(kubeClient *kclient.Client, callback func(interface{})) kcache.Store {
-	serviceStore, serviceController := kframework.NewInformer(
-		createServiceLW(kubeClient),
-		&kapi.Service{},
-		0,
-		kframework.ResourceEventHandlerFuncs{
-			AddFunc:    callback,
-			DeleteFunc: callback,
-			UpdateFunc: func(a interface{}, b interface{}) { callback(b) },
-		},
-	)
-	go serviceController.Run(wait.NeverStop)
-	return serviceStore
-}
+	// every write to the rules directory happens from the reconciler
+	reconciler := NewReconciler(*rulesLocation, *syncQuietPeriod, *syncMaxDelay, health, leader)
+
+	// namespaces select the defaults profiles of the rules in them
+	namespaces := NewNamespaceCache(kubeClient)
 
-func gatherRulesFromServices(kubeClient *kclient.Client) []map[string]interface{} {
-	si := kubeClient.Services(kapi.NamespaceAll)
-	serviceList, err := si.List(kapi.ListOptions{
-		LabelSelector: klabels.Everything(),
-		FieldSelector: kselector.Everything()})
+	// every rule is re-rendered when the Alertmanager moves
+	var alertmanager *AlertmanagerDiscovery
+	if *alertmanagerService != "" {
+		alertmanager = NewAlertmanagerDiscovery(kubeClient, *alertmanagerNamespace, *alertmanagerService, *alertmanagerPort, *alertmanagerEndpoints, reconciler.Resync)
+	}
+	// rules may only read the secrets that were labeled for them
+	secrets, err := labels.Parse(*secretSelector)
 	if err != nil {
-		log.Printf("Unable to list services: %s", err)
+		log.Fatalf("Invalid Secret selector %q: %s\n", *secretSelector, err)
 	}
+	renderer := NewRuleRenderer(kubeClient, secrets, defaults, templates, namespaces, alertmanager)
 
-	var ruleList []map[string]interface{}
-	var rule map[string]interface{}
-
-	for _, svc := range serviceList.Items {
-		anno := svc.GetObjectMeta().GetAnnotations()
-		name := svc.GetObjectMeta().GetName()
-		log.Printf("Processing Service - %s\n", name)
-
-		for k, v := range anno {
-			if k == *annotationKey {
-				if err := yaml.Unmarshal([]byte(v), &rule); err != nil {
-					log.Printf("Unable to unmarshal elastalert rule for service %s. Error: %s; Rule: %s. Skipping rule.\n", name, err, v)
-					continue
-				}
-				ruleList = append(ruleList, rule)
-			}
-		}
+	// initial configmap rules pull happens on the first sync.
+	configMapRules := NewConfigMapMountSource(*configMapLocation, renderer, reconciler.Signal)
+	reconciler.AddSource(configMapRules)
+
+	// rule status is written back onto the objects from its own goroutine
+	var status *StatusReporter
+	if *statusAnnotationKey != "" && !outOfCluster {
+		status = NewStatusReporter(kubeClient, *statusAnnotationKey, leader)
+		go status.Run(stopCh)
 	}
 
-	return ruleList
-}
+	// setup a watcher for each annotated resource, syncs all of its rules once the cache is filled
+	kinds, err := parseAnnotatedKinds(kubeClient, *annotatedResources)
+	if err != nil {
+		log.Fatalf("Invalid annotated resources: %s\n", err)
+	}
+	for _, kind := range kinds {
+		objectRules := NewObjectRuleController(kind, reconciler.Signal, renderer, namespaces, status)
+		reconciler.AddSource(objectRules)
+		go objectRules.Run(stopCh)
+	}
 
-func GatherFilesFromConfigmap(configMapLocation string) []string {
-	fileList := []string{}
-	err := filepath.Walk(configMapLocation, func(path string, f os.FileInfo, err error) error {
-		stat, err := os.Stat(path)
+	// ElastalertRule resources get their status written into their own status
+	if *ruleResources {
+		ruleClient, err := NewRuleResourceClient(config)
 		if err != nil {
-			log.Printf("Cannot stat %s, %s\n", path, err)
-		}
-		if !stat.IsDir() {
-			// ignore the configmap /..dirname directories
-			if !(strings.Contains(path, "/..")) {
-				fileList = append(fileList, path)
-			}
+			log.Fatalf("Failed to create ElastalertRule client: %v", err)
 		}
-		return nil
-	})
-	if err != nil {
-		// not sure what I might see here, so making this fatal for now
-		log.Printf("Cannot process path: %s, %s\n", configMapLocation, err)
+		ruleResourceRules := NewObjectRuleController(elastalertRuleKind(ruleClient), reconciler.Signal, renderer, namespaces, status)
+		reconciler.AddSource(ruleResourceRules)
+		go ruleResourceRules.Run(stopCh)
 	}
-	return fileList
-}
 
-func updateServiceRules(kubeClient *kclient.Client, rulesLocation string) bool {
-	log.Println("Processing Service rules.")
-	ruleFileExt := ".service.yaml"
-	ruleList := gatherRulesFromServices(kubeClient)
+	// ConfigMaps carrying rules are watched like services
+	if *configMapSelector != "" {
+		selector, err := labels.Parse(*configMapSelector)
+		if err != nil {
+			log.Fatalf("Invalid ConfigMap selector %q: %s\n", *configMapSelector, err)
+		}
+		configMapObjectRules := NewObjectRuleController(configMapKind(kubeClient, selector), reconciler.Signal, renderer, namespaces, status)
+		reconciler.AddSource(configMapObjectRules)
+		go configMapObjectRules.Run(stopCh)
+	}
 
-	// delete old rules
-	cmd := exec.Command("rm", "-rf", fmt.Sprintf("*%s", ruleFileExt))
-	log.Printf("Deleting old service rules.\n")
-	err := cmd.Start()
+	// setup file watcher, will trigger whenever the configmap updates
+	var watchers []*FileWatcher
+	watcher, err := WatchFile(*configMapLocation, time.Second, func() {
+		log.Printf("ConfigMap files updated.\n")
+		configMapRules.Resync()
+		reconciler.Signal()
+	})
 	if err != nil {
-		log.Printf("Unable to delete old service rules. Error: %s\n", err)
+		log.Fatalf("Unable to watch ConfigMap: %s\n", err)
 	}
-	err = cmd.Wait()
-	log.Printf("Command finished with exit code: %v\n", err)
-
-	for _, rule := range ruleList {
-		erule, err := processRule(rule)
+	watchers = append(watchers, watcher)
+
+	// every rule is re-rendered when the defaults change
+	if *defaultsFile != "" {
+		defaultsWatcher, err := WatchFile(*defaultsFile, time.Second, func() {
+			if err := defaults.Reload(); err != nil {
+				log.Printf("%s. Keeping the previous defaults.\n", err)
+				return
+			}
+			reconciler.Resync()
+		})
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatalf("Unable to watch defaults file: %s\n", err)
 		}
-		err = writeRule(erule, rulesLocation, ruleFileExt)
+		watchers = append(watchers, defaultsWatcher)
+	}
+
+	// rules referencing a template are re-rendered when the library changes
+	if templates != nil {
+		templatesWatcher, err := WatchFile(*templateLibrary, time.Second, func() {
+			templates.Reload()
+			reconciler.Resync()
+		})
 		if err != nil {
-			log.Printf("%s\n", err)
+			log.Fatalf("Unable to watch template library: %s\n", err)
 		}
+		watchers = append(watchers, templatesWatcher)
 	}
-	return true
-}
 
-func updateConfigMapRules(configMapLocation string, rulesLocation string) {
-	log.Println("Processing ConfigMap rules.")
-	ruleFileExt := ".configmap.yaml"
-	fileList := GatherFilesFromConfigmap(configMapLocation)
+	// Started only now, since their events reach the listeners registered with the
+	// namespaces and every source of the reconciler.
+	go namespaces.Run(stopCh)
+	if alertmanager != nil {
+		alertmanager.Run(stopCh)
+	}
 
-	for _, file := range fileList {
-		content, err := processRuleFile(file)
-		if err != nil {
-			log.Println(err)
-			continue
+	// rules rendered before the namespaces and the Alertmanager are known would be
+	// rendered again right away
+	started := waitUntil(renderer.HasSynced, stopCh)
+	if started {
+		go reconciler.Run(stopCh)
+		reconciler.Signal()
+		if leader != nil {
+			// a new leader resyncs everything, whatever it missed as a follower
+			go leader.Run(stopCh, reconciler.Resync)
 		}
-		err = writeRule(content, rulesLocation, ruleFileExt)
-		if err != nil {
-			log.Printf("%s\n", err)
+	}
+
+	<-stopCh
+	log.Printf("Cleaning up.\n")
+	for _, w := range watchers {
+		w.Close()
+	}
+	if started {
+		shutdown(reconciler, status, *shutdownTimeout)
+	}
+	log.Printf("Shut down.\n")
+}
+
+// waitUntil polls cond until it holds. It returns false if stopCh closed first.
+func waitUntil(cond func() bool, stopCh <-chan struct{}) bool {
+	for !cond() {
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(100 * time.Millisecond):
 		}
 	}
+	return true
 }
 
-func writeRule(rule elastalertRule, rulesLocation, extension string) error {
-	filename := fmt.Sprintf("%s/%s%s", rulesLocation, rule.name, extension)
-	f, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("Unable to open rules file %s for writing. Error: %s", filename, err)
+// shutdown waits for the sync in flight to finish and flushes the pending status
+// updates, giving up on both once the timeout passed.
+func shutdown(reconciler *Reconciler, status *StatusReporter, timeout time.Duration) {
+	deadline := time.After(timeout)
+	select {
+	case <-reconciler.Done():
+	case <-deadline:
+		log.Printf("Timed out waiting for the rule sync in flight.\n")
+		return
+	}
+	if status == nil {
+		return
 	}
-	defer f.Close()
 
-	w := bufio.NewWriter(f)
-	byteCount, err := w.WriteString(rule.rule)
-	if err != nil {
+	flushed := make(chan struct{})
+	go func() {
+		status.Flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-deadline:
+		log.Printf("Timed out flushing rule status updates.\n")
+	}
+}
+
+func writeRule(rule elastalertRule, writer RuleWriter, filename string) error {
+	perm := os.FileMode(0644)
+	if rule.secret {
+		perm = secretRuleFileMode
+	}
+	if err := writer.WriteFile(filename, []byte(rule.rule), perm); err != nil {
 		return fmt.Errorf("Unable to write rule. Rulename: %s Error: %s", rule.name, err)
 	}
-	log.Printf("Wrote %d bytes.\n", byteCount)
-	w.Flush()
+	log.Printf("Wrote %d bytes to %s.\n", len(rule.rule), filename)
 
 	return nil
 }
 
-func loadConfig(configFile string) string {
+func loadConfig(configFile string) (string, error) {
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Fatalf("Cannot read ConfigMap file: %s\n", err)
+		return "", err
 	}
 
-	return string(configData)
+	return string(configData), nil
 }
 
-func processRuleFile(file string) (elastalertRule, error) {
-	configManager := NewMutexConfigManager(loadConfig(file))
+// processRuleFile reads and renders the rules of a rule file. The error of reading
+// the file is returned as is, so a file removed in the meantime can be told apart.
+func processRuleFile(file string, pass *renderPass, context templateContext) ([]elastalertRule, error) {
+	data, err := loadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	configManager := NewMutexConfigManager(data)
 	defer func() {
 		configManager.Close()
 	}()
 
-	rule := configManager.Get()
-
-	var urule map[string]interface{}
-	if err := yaml.Unmarshal([]byte(rule), &urule); err != nil {
-		return elastalertRule{}, fmt.Errorf("Unable to unmarshal elastalert rule from configmap supplied file %s. Error: %s; Rule: %s. Skipping rule.\n", file, err, rule)
+	rule, err := renderRuleTemplate(file, configManager.Get(), context)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to render elastalert rule template from configmap supplied file %s. Error: %s. Skipping rule.", file, err)
 	}
-	eaRule, err := processRule(urule)
 
+	urules, err := parseRules(rule)
 	if err != nil {
-		return elastalertRule{}, err
+		return nil, fmt.Errorf("Unable to unmarshal elastalert rule from configmap supplied file %s. Error: %s; Rule: %s. Skipping rule.\n", file, err, rule)
 	}
 
-	return eaRule, nil
+	eaRules, errs := pass.render(urules, context)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("Unable to process elastalert rule from configmap supplied file %s. Error: %s", file, errs[0])
+	}
+
+	return eaRules, nil
 }
 
-func processRule(ruleMap map[string]interface{}) (elastalertRule, error) {
-	eaRule := elastalertRule{}
-	if str, ok := ruleMap["name"]; ok {
-		eaRule.name = str.(string)
+// Longest rule name accepted.
+const maxRuleName = 253
+
+// validateRuleName rejects rule names that look like an attempt to reach outside
+// the rules directory, or that would not survive being turned into a file name.
+func validateRuleName(name string) error {
+	switch {
+	case len(name) > maxRuleName:
+		return fmt.Errorf("Rule name is longer than %d bytes", maxRuleName)
+	case name == "." || name == "..":
+		return fmt.Errorf("Rule name %q is not allowed", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("Rule name %q contains a path separator", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("Rule name %q contains a control character", name)
+		}
 	}
+	return nil
+}
+
+// parseRules reads every rule in an annotation value or rule file, which may hold a
+// single rule, a YAML list of rules, or several YAML documents.
+func parseRules(value string) ([]map[string]interface{}, error) {
+	var ruleList []map[string]interface{}
+	for _, doc := range splitYAMLDocuments(value) {
+		var probe interface{}
+		if err := yaml.Unmarshal([]byte(doc), &probe); err != nil {
+			return nil, err
+		}
 
-	// Set 'index' if not set
-	if _, ok := ruleMap["index"]; !ok {
-		ruleMap["index"] = "*"
+		var rules []map[string]interface{}
+		switch probe.(type) {
+		case nil:
+			// empty document
+			continue
+		case []interface{}:
+			if err := yaml.Unmarshal([]byte(doc), &rules); err != nil {
+				return nil, err
+			}
+		case map[interface{}]interface{}:
+			var rule map[string]interface{}
+			if err := yaml.Unmarshal([]byte(doc), &rule); err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		default:
+			return nil, fmt.Errorf("Expected a rule or a list of rules, found %v", probe)
+		}
+
+		for _, rule := range rules {
+			if rule == nil {
+				return nil, fmt.Errorf("Found an empty rule")
+			}
+			ruleList = append(ruleList, rule)
+		}
 	}
-	// Set 'alert' if not set
-	if _, ok := ruleMap["alert"]; !ok {
-		ruleMap["alert"] = "elastalert_modules.prometheus_alertmanager.PrometheusAlertManagerAlerter"
+	return ruleList, nil
+}
+
+// splitYAMLDocuments splits a YAML stream on its "---" document separators.
+func splitYAMLDocuments(value string) []string {
+	var docs []string
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if strings.TrimRight(line, " \t\r") == "---" {
+			docs = append(docs, strings.Join(lines, "\n"))
+			lines = nil
+			continue
+		}
+		lines = append(lines, line)
 	}
-	// Set 'alertmanager_url' if not set
-	if _, ok := ruleMap["alertmanager_url"]; !ok {
-		ruleMap["alertmanager_url"] = fmt.Sprintf("http://%s:%s/", os.Getenv("ALERTMANAGER_SERVICE_HOST"), os.Getenv("ALERTMANAGER_SERVICE_PORT"))
+	return append(docs, strings.Join(lines, "\n"))
+}
+
+func processRule(ruleMap map[string]interface{}, defaults *RuleDefaults, secrets secretLookup) (elastalertRule, error) {
+	eaRule := elastalertRule{}
+	if str, ok := ruleMap["name"].(string); ok && str != "" {
+		eaRule.name = str
+	} else {
+		return elastalertRule{}, fmt.Errorf("Elastalert rule has no name. Rule: %s. Skipping rule.", ruleMap)
+	}
+	if err := validateRuleName(eaRule.name); err != nil {
+		return elastalertRule{}, fmt.Errorf("Invalid elastalert rule name. Error: %s. Skipping rule.", err)
 	}
-	// Set 'use_kibana4_dashboard' if not set
-	if _, ok := ruleMap["use_kibana4_dashboard"]; !ok {
-		ruleMap["use_kibana4_dashboard"] = "/_plugin/kibana/#/dashboard"
+
+	defaults.apply(ruleMap)
+
+	if err := validateRule(ruleMap); err != nil {
+		return elastalertRule{}, fmt.Errorf("Invalid elastalert rule %q. Error: %s. Skipping rule.", eaRule.name, err)
 	}
-	// Set 'use_kibana4_dashboard' if not set
-	if _, ok := ruleMap["aws_region"]; !ok {
-		ruleMap["aws_region"] = os.Getenv("ELASTICSEARCH_AWS_REGION")
+
+	// Secrets are resolved after validation, so their values never end up in an error.
+	secret, err := resolveRuleSecrets(ruleMap, secrets)
+	if err != nil {
+		return elastalertRule{}, wrapSecretError(err, "Unable to resolve secrets of elastalert rule %q. Error: %s. Skipping rule.", eaRule.name, err)
 	}
+	eaRule.secret = secret
 
 	r, err := yaml.Marshal(&ruleMap)
 	if err != nil {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRuleName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"error-rate", true},
+		{"Error rate of the frontend", true},
+		{"..hidden", true},
+		{".", false},
+		{"..", false},
+		{"../../etc/passwd", false},
+		{"/etc/passwd", false},
+		{"a/b", false},
+		{`..\..\x`, false},
+		{"a\nb", false},
+		{"a\rb", false},
+		{"a\x00b", false},
+		{"a\tb", false},
+		{"a\x7fb", false},
+		{strings.Repeat("x", maxRuleName), true},
+		{strings.Repeat("x", maxRuleName+1), false},
+	}
+
+	for _, test := range tests {
+		err := validateRuleName(test.name)
+		if test.ok && err != nil {
+			t.Errorf("validateRuleName(%q) failed: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("validateRuleName(%q) succeeded, expected an error", test.name)
+		}
+	}
+}
+
+func TestShutdownWaitsForSyncInFlight(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	stopCh := make(chan struct{})
+	reconciler, source := startReconciler(t, dir, stopCh)
+	close(stopCh)
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(reconciler, nil, 5*time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Shut down while a sync was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(source.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not shut down after the sync finished")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	stopCh := make(chan struct{})
+	reconciler, source := startReconciler(t, dir, stopCh)
+	close(stopCh)
+
+	start := time.Now()
+	shutdown(reconciler, nil, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutting down took %s, expected the timeout of 50ms", elapsed)
+	}
+
+	close(source.release)
+	<-reconciler.Done()
+}
+
+// stoppedReconciler returns a reconciler whose Run already returned.
+func stoppedReconciler() *Reconciler {
+	reconciler := NewReconciler(os.TempDir(), time.Millisecond, 10*time.Millisecond, nil, nil)
+	stopCh := make(chan struct{})
+	close(stopCh)
+	reconciler.Run(stopCh)
+	return reconciler
+}
+
+func TestShutdownFlushesStatus(t *testing.T) {
+	server := newFakeStatusServer(nil)
+	defer server.Close()
+	status := reportRulesStatus(t, server)
+
+	shutdown(stoppedReconciler(), status, 5*time.Second)
+	if written := server.statuses(); len(written) != 1 {
+		t.Errorf("Flushed %d statuses, expected 1", len(written))
+	}
+}
+
+func TestShutdownStatusTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := newFakeStatusServer(release)
+	defer server.Close()
+	defer close(release)
+	status := reportRulesStatus(t, server)
+
+	start := time.Now()
+	shutdown(stoppedReconciler(), status, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutting down took %s, expected the timeout of 50ms", elapsed)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Name of the file, inside the rules directory, recording which rules the loader owns.
+	// It does not end in .yaml so elastalert never tries to load it as a rule.
+	manifestFileName = ".elastalertRuleLoader.manifest.json"
+
+	// Rule source kinds recorded in the manifest.
+	sourceService        = "service"
+	sourceConfigMapMount = "configmap-mount"
+	sourceConfigMap      = "configmap"
+	sourceDeployment     = "deployment"
+	sourceReplicaSet     = "replicaset"
+	sourceDaemonSet      = "daemonset"
+	sourceJob            = "job"
+	sourceIngress        = "ingress"
+	sourceRuleResource   = "elastalertrule"
+)
+
+// File name suffix for the rules of each source kind.
+var ruleFileSuffixes = map[string]string{
+	sourceService:        ".service.yaml",
+	sourceConfigMapMount: ".configmap.yaml",
+	sourceConfigMap:      ".configmap-api.yaml",
+	sourceDeployment:     ".deployment.yaml",
+	sourceReplicaSet:     ".replicaset.yaml",
+	sourceDaemonSet:      ".daemonset.yaml",
+	sourceJob:            ".job.yaml",
+	sourceIngress:        ".ingress.yaml",
+	sourceRuleResource:   ".elastalertrule.yaml",
+}
+
+/*
+ Identifies the object a rule was read from.
+*/
+type ruleOrigin struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	UID       string `json:"uid,omitempty"`
+}
+
+func (self ruleOrigin) String() string {
+	if self.Namespace == "" {
+		return fmt.Sprintf("%s %s", self.Kind, self.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", self.Kind, self.Namespace, self.Name)
+}
+
+/*
+ A single file written by the loader, along with where its content came from.
+*/
+type manifestEntry struct {
+	ruleOrigin
+	RuleName string `json:"ruleName,omitempty"`
+	Hash     string `json:"hash"`
+}
+
+/*
+ Records every file in the rules directory that the loader wrote, keyed by file name.
+ Files that are not in the manifest were placed there by someone else and are never
+ modified or removed.
+*/
+type RuleManifest struct {
+	Rules map[string]manifestEntry `json:"rules"`
+}
+
+func loadManifest(rulesLocation string) (*RuleManifest, error) {
+	manifest := &RuleManifest{Rules: map[string]manifestEntry{}}
+
+	data, err := ioutil.ReadFile(filepath.Join(rulesLocation, manifestFileName))
+	if os.IsNotExist(err) {
+		manifest.adoptLegacyRules(rulesLocation)
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rule manifest. Error: %s", err)
+	}
+
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal rule manifest. Error: %s", err)
+	}
+	if manifest.Rules == nil {
+		manifest.Rules = map[string]manifestEntry{}
+	}
+	return manifest, nil
+}
+
+// Suffixes of the rule files written by loader versions that predate the manifest.
+var legacyRuleFileSuffixes = map[string]string{
+	sourceService:        ruleFileSuffixes[sourceService],
+	sourceConfigMapMount: ruleFileSuffixes[sourceConfigMapMount],
+}
+
+// adoptLegacyRules takes ownership of files written by loader versions that
+// predate the manifest, so rules for deleted objects are cleaned up after an upgrade.
+// Files of the newer source kinds were placed there by hand and are left alone.
+func (self *RuleManifest) adoptLegacyRules(rulesLocation string) {
+	files, err := ioutil.ReadDir(rulesLocation)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to list rules directory %s. Error: %s\n", rulesLocation, err)
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		for kind, suffix := range legacyRuleFileSuffixes {
+			if strings.HasSuffix(f.Name(), suffix) {
+				log.Printf("Adopting rule file %s written by a previous loader version.\n", f.Name())
+				self.Rules[f.Name()] = manifestEntry{ruleOrigin: ruleOrigin{Kind: kind}}
+			}
+		}
+	}
+}
+
+func (self *RuleManifest) save(writer RuleWriter) error {
+	data, err := json.MarshalIndent(self, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal rule manifest. Error: %s", err)
+	}
+
+	if err := writer.WriteFile(manifestFileName, data, 0644); err != nil {
+		return fmt.Errorf("Unable to write rule manifest. Error: %s", err)
+	}
+	return nil
+}
+
+// ruleHash hashes a rendered rule. processRule marshals rules with sorted map keys,
+// so equal rules always render, and hash, identically.
+func ruleHash(rule string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(rule)))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAdoptLegacyRules(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"frontend.service.yaml", "rules.configmap.yaml", "worker.deployment.yaml", "nightly.job.yaml", "custom.yaml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]manifestEntry{
+		"frontend.service.yaml": {ruleOrigin: ruleOrigin{Kind: sourceService}},
+		"rules.configmap.yaml":  {ruleOrigin: ruleOrigin{Kind: sourceConfigMapMount}},
+	}
+	if !reflect.DeepEqual(manifest.Rules, expected) {
+		t.Errorf("Adopted %v, expected %v", manifest.Rules, expected)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// Prefix of every metric the loader exports.
+const metricsNamespace = "elastalert_rule_loader"
+
+var (
+	rulesLoaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rules_loaded_total",
+		Help:      "Rule files written to the rules directory, by rule source kind and namespace.",
+	}, []string{"source", "namespace"})
+	rulesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rules_rejected_total",
+		Help:      "Rules that could not be read, rendered, validated or written, by rule source kind and namespace.",
+	}, []string{"source", "namespace"})
+	rulesDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rules_deleted_total",
+		Help:      "Rule files removed from the rules directory, by rule source kind and namespace.",
+	}, []string{"source", "namespace"})
+	syncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "How long syncs of the rules directory took.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	lastSuccessfulSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "When the rules directory was last synced successfully, in seconds since the epoch.",
+	})
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_errors_total",
+		Help:      "Failed list and watch requests to the API server, by resource and verb.",
+	}, []string{"resource", "verb"})
+	fileWatcherEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "file_watcher_events_total",
+		Help:      "File system events seen by the file watchers, by watched path and operation.",
+	}, []string{"path", "op"})
+)
+
+func init() {
+	prometheus.MustRegister(rulesLoaded)
+	prometheus.MustRegister(rulesRejected)
+	prometheus.MustRegister(rulesDeleted)
+	prometheus.MustRegister(syncDuration)
+	prometheus.MustRegister(lastSuccessfulSync)
+	prometheus.MustRegister(apiErrors)
+	prometheus.MustRegister(fileWatcherEvents)
+}
+
+/*
+ Counts the list and watch requests of an informer that fail, and tracks how long
+ they have been failing for the liveness check. namespace is empty for informers
+ of every namespace; it tells informers of the same resource apart, so one that
+ succeeds does not hide the failures of another.
+*/
+func instrumentListWatch(resource, namespace string, lw *kcache.ListWatch) *kcache.ListWatch {
+	informer := resource
+	if namespace != "" {
+		informer = resource + " in " + namespace
+	}
+	list, watchFunc := lw.ListFunc, lw.WatchFunc
+	return &kcache.ListWatch{
+		ListFunc: func(options kapi.ListOptions) (runtime.Object, error) {
+			obj, err := list(options)
+			if err != nil {
+				apiErrors.WithLabelValues(resource, "list").Inc()
+				apiWatchHealth.failed(informer)
+			} else {
+				apiWatchHealth.succeeded(informer)
+			}
+			return obj, err
+		},
+		WatchFunc: func(options kapi.ListOptions) (watch.Interface, error) {
+			w, err := watchFunc(options)
+			if err != nil {
+				apiErrors.WithLabelValues(resource, "watch").Inc()
+				apiWatchHealth.failed(informer)
+			} else {
+				apiWatchHealth.succeeded(informer)
+			}
+			return w, err
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"reflect"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+	kselector "k8s.io/kubernetes/pkg/fields"
+)
+
+/*
+ Caches the namespaces so defaults profiles can be selected by namespace labels and
+ annotations. Listeners are told about every namespace whose labels or annotations
+ changed, so the rules in it can be rendered again.
+*/
+type NamespaceCache struct {
+	store      kcache.Store
+	controller *kframework.Controller
+	listeners  []func(namespace string)
+}
+
+func NewNamespaceCache(kubeClient *kclient.Client) *NamespaceCache {
+	cache := &NamespaceCache{}
+	cache.store, cache.controller = kframework.NewInformer(
+		instrumentListWatch("namespaces", kapi.NamespaceAll, kcache.NewListWatchFromClient(kubeClient, "namespaces", kapi.NamespaceAll, kselector.Everything())),
+		&kapi.Namespace{},
+		0,
+		kframework.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				cache.changed(obj.(*kapi.Namespace).Name)
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				oldNs, curNs := old.(*kapi.Namespace), cur.(*kapi.Namespace)
+				if !reflect.DeepEqual(oldNs.Labels, curNs.Labels) || !reflect.DeepEqual(oldNs.Annotations, curNs.Annotations) {
+					cache.changed(curNs.Name)
+				}
+			},
+		},
+	)
+	return cache
+}
+
+// OnChange registers a listener. Listeners must be registered before Run.
+func (self *NamespaceCache) OnChange(listener func(namespace string)) {
+	self.listeners = append(self.listeners, listener)
+}
+
+func (self *NamespaceCache) Run(stopCh <-chan struct{}) {
+	self.controller.Run(stopCh)
+}
+
+func (self *NamespaceCache) HasSynced() bool {
+	return self.controller.HasSynced()
+}
+
+// DefaultsFor layers the profiles selecting a namespace over the global defaults.
+func (self *NamespaceCache) DefaultsFor(defaults *RuleDefaults, namespace string) *RuleDefaults {
+	if self == nil || defaults == nil || len(defaults.Profiles) == 0 {
+		return defaults
+	}
+
+	var labels, annotations map[string]string
+	obj, exists, err := self.store.GetByKey(namespace)
+	if err != nil {
+		log.Printf("Unable to get namespace %s. Error: %s\n", namespace, err)
+	} else if exists {
+		ns := obj.(*kapi.Namespace)
+		labels, annotations = ns.Labels, ns.Annotations
+	}
+	return defaults.forNamespace(namespace, labels, annotations)
+}
+
+func (self *NamespaceCache) changed(namespace string) {
+	for _, listener := range self.listeners {
+		listener(namespace)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/meta"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+	kselector "k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+/*
+ Describes how rules are read from one kind of object: where the objects are listed
+ and watched, and which of their documents, such as annotations or data keys, hold
+ rules.
+*/
+type objectKind struct {
+	// the source kind recorded in the manifest
+	source     string
+	kind       string
+	apiVersion string
+	resource   string
+	// the client of the API group the resource belongs to
+	client *restclient.RESTClient
+	// the API group is not known to the client's scheme, so list options are sent
+	// as plain query parameters
+	rawParams bool
+	// only objects with matching labels are watched
+	selector  labels.Selector
+	newObject func() runtime.Object
+
+	// what a document is called in errors, e.g. annotation
+	document  string
+	documents func(obj runtime.Object) map[string]string
+	// the label selector of objects that have one, may be nil
+	templateSelector func(obj runtime.Object) map[string]string
+	// objects whose rules are loaded from another object, may be nil; they never
+	// hold rules of their own, and no status is written onto them
+	skip func(obj runtime.Object) bool
+}
+
+// skipped reports whether the rules of an object are loaded from another object.
+func (self *objectKind) skipped(obj runtime.Object) bool {
+	return self.skip != nil && self.skip(obj)
+}
+
+// objectMeta returns the metadata of an API object. Every kind embeds ObjectMeta,
+// but only some implement meta.ObjectMetaAccessor.
+func objectMeta(obj runtime.Object) meta.Object {
+	return obj.(meta.Object)
+}
+
+func (self *objectKind) origin(obj runtime.Object) ruleOrigin {
+	m := objectMeta(obj)
+	return ruleOrigin{
+		Kind:      self.source,
+		Namespace: m.GetNamespace(),
+		Name:      m.GetName(),
+		UID:       string(m.GetUID()),
+	}
+}
+
+// listWatch lists and watches the objects of the kind in every namespace.
+func (self *objectKind) listWatch() *kcache.ListWatch {
+	return instrumentListWatch(self.resource, kapi.NamespaceAll, self.newListWatch())
+}
+
+func (self *objectKind) newListWatch() *kcache.ListWatch {
+	if self.rawParams {
+		return &kcache.ListWatch{
+			ListFunc: func(options kapi.ListOptions) (runtime.Object, error) {
+				return self.listRequest(options).Do().Get()
+			},
+			WatchFunc: func(options kapi.ListOptions) (watch.Interface, error) {
+				return self.listRequest(options).Prefix("watch").Watch()
+			},
+		}
+	}
+
+	lw := kcache.NewListWatchFromClient(self.client, self.resource, kapi.NamespaceAll, kselector.Everything())
+	if self.selector.Empty() {
+		return lw
+	}
+	list, watchFunc := lw.ListFunc, lw.WatchFunc
+	lw.ListFunc = func(options kapi.ListOptions) (runtime.Object, error) {
+		options.LabelSelector = self.selector
+		return list(options)
+	}
+	lw.WatchFunc = func(options kapi.ListOptions) (watch.Interface, error) {
+		options.LabelSelector = self.selector
+		return watchFunc(options)
+	}
+	return lw
+}
+
+func (self *objectKind) listRequest(options kapi.ListOptions) *restclient.Request {
+	req := self.client.Get().Namespace(kapi.NamespaceAll).Resource(self.resource)
+	if !self.selector.Empty() {
+		req.Param("labelSelector", self.selector.String())
+	}
+	if options.ResourceVersion != "" {
+		req.Param("resourceVersion", options.ResourceVersion)
+	}
+	if options.TimeoutSeconds != nil {
+		req.Param("timeoutSeconds", strconv.FormatInt(*options.TimeoutSeconds, 10))
+	}
+	return req
+}
+
+/*
+ Keeps the rules of one kind of object in the rules directory in sync with the
+ objects held in an informer cache. An object event only reconciles the rules of
+ that object; a full sync against the cache runs on Resync to clean up after
+ anything that was missed.
+*/
+type ObjectRuleController struct {
+	kind       *objectKind
+	store      kcache.Store
+	controller *kframework.Controller
+	queue      *RateLimitedQueue
+	notify     func()
+	renderer   *RuleRenderer
+	namespaces *NamespaceCache
+	status     *StatusReporter
+
+	mutex    *sync.Mutex
+	synced   bool
+	fullSync bool
+}
+
+// NewObjectRuleController creates the controller. status may be nil, in which case
+// nothing is reported back onto the objects.
+func NewObjectRuleController(kind *objectKind, notify func(), renderer *RuleRenderer, namespaces *NamespaceCache, status *StatusReporter) *ObjectRuleController {
+	src := &ObjectRuleController{
+		kind:       kind,
+		queue:      NewRateLimitedQueue(queueQPS, queueBurst, queueInitialBackoff, queueMaxBackoff, notify),
+		notify:     notify,
+		renderer:   renderer,
+		namespaces: namespaces,
+		status:     status,
+		mutex:      &sync.Mutex{},
+	}
+	src.store, src.controller = kframework.NewInformer(
+		kind.listWatch(),
+		kind.newObject(),
+		0,
+		kframework.ResourceEventHandlerFuncs{
+			AddFunc:    src.enqueue,
+			DeleteFunc: src.enqueue,
+			UpdateFunc: func(a interface{}, b interface{}) { src.enqueue(b) },
+		},
+	)
+	namespaces.OnChange(src.enqueueNamespace)
+	return src
+}
+
+func (self *ObjectRuleController) Run(stopCh <-chan struct{}) {
+	go self.controller.Run(stopCh)
+
+	// Rules of objects missing from a partially filled cache would be removed
+	// by the first full sync, so wait for the initial list to complete.
+	for !self.controller.HasSynced() {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	log.Printf("%s cache synced.\n", self.kind.kind)
+
+	self.mutex.Lock()
+	self.synced = true
+	self.fullSync = true
+	self.mutex.Unlock()
+	self.notify()
+
+	<-stopCh
+	self.queue.ShutDown()
+}
+
+func (self *ObjectRuleController) HasSynced() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.synced
+}
+
+func (self *ObjectRuleController) Resync() {
+	self.mutex.Lock()
+	self.fullSync = true
+	self.mutex.Unlock()
+}
+
+func (self *ObjectRuleController) Sync(s *ruleSync) {
+	self.mutex.Lock()
+	synced, fullSync := self.synced, self.fullSync
+	self.fullSync = false
+	self.mutex.Unlock()
+	if !synced {
+		return
+	}
+
+	keys := self.queue.Drain()
+	pass := self.renderer.begin()
+	if fullSync {
+		self.syncAll(s, pass)
+		return
+	}
+	for _, key := range keys {
+		if err := self.syncObject(s, pass, key); err != nil {
+			log.Printf("Unable to sync rules for %s %s. Error: %s\n", self.kind.source, key, err)
+			self.queue.AddRateLimited(key)
+		} else {
+			self.queue.Forget(key)
+		}
+	}
+}
+
+// Committed reports what the sync did with the rules of each object it covered
+// onto that object.
+func (self *ObjectRuleController) Committed(s *ruleSync) {
+	if self.status == nil {
+		return
+	}
+	for origin, result := range s.results {
+		if origin.Kind != self.kind.source {
+			continue
+		}
+		obj, exists, err := self.store.GetByKey(origin.Namespace + "/" + origin.Name)
+		if err != nil || !exists {
+			continue
+		}
+		if string(objectMeta(obj.(runtime.Object)).GetUID()) != origin.UID {
+			// replaced since the sync ran, its own sync reports on it
+			continue
+		}
+		if self.kind.skipped(obj.(runtime.Object)) {
+			// taken over since the sync ran, e.g. adopted by a deployment
+			continue
+		}
+		self.status.Report(self.kind, origin, obj.(runtime.Object), result)
+	}
+}
+
+func (self *ObjectRuleController) enqueue(obj interface{}) {
+	key, err := kframework.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Printf("Unable to get key for %s. Error: %s\n", self.kind.source, err)
+		return
+	}
+	self.queue.Add(key)
+}
+
+// enqueueNamespace queues every object of a namespace whose profiles may have changed.
+func (self *ObjectRuleController) enqueueNamespace(namespace string) {
+	prefix := namespace + "/"
+	for _, key := range self.store.ListKeys() {
+		if strings.HasPrefix(key, prefix) {
+			self.queue.Add(key)
+		}
+	}
+}
+
+// syncObject reconciles the rules of a single object from the cache.
+func (self *ObjectRuleController) syncObject(s *ruleSync, pass *renderPass, key string) error {
+	namespace, name, err := kcache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	obj, exists, err := self.store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	var ruleList []elastalertRule
+	if exists {
+		if ruleList, err = self.rulesFromObject(s, pass, obj.(runtime.Object)); err != nil {
+			return err
+		}
+	}
+	return s.reconcile(ownsObject(self.kind.source, namespace, name), ruleList)
+}
+
+// syncAll reconciles the rules of every object in the cache.
+func (self *ObjectRuleController) syncAll(s *ruleSync, pass *renderPass) {
+	log.Printf("Processing %s rules.\n", self.kind.kind)
+
+	// a stable order keeps the same rule winning when two objects use a rule name
+	keys := self.store.ListKeys()
+	sort.Strings(keys)
+
+	var ruleList []elastalertRule
+	// objects whose rules are left as they are until they can be read
+	skipped := map[string]bool{}
+	for _, key := range keys {
+		obj, exists, err := self.store.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		rules, err := self.rulesFromObject(s, pass, obj.(runtime.Object))
+		if err != nil {
+			log.Printf("Unable to sync rules for %s %s. Error: %s\n", self.kind.source, key, err)
+			skipped[key] = true
+			self.queue.AddRateLimited(key)
+			continue
+		}
+		ruleList = append(ruleList, rules...)
+	}
+
+	owns := func(origin ruleOrigin) bool {
+		return origin.Kind == self.kind.source && !skipped[origin.Namespace+"/"+origin.Name]
+	}
+	if err := s.reconcile(owns, ruleList); err != nil {
+		log.Printf("Unable to sync %s rules. Error: %s\n", self.kind.source, err)
+		self.Resync()
+		time.AfterFunc(syncRetryDelay, self.notify)
+	}
+}
+
+/*
+ Reads the rules of an object, recording every rule that could not be read against
+ the object in the sync. If a secret the rules refer to could not be read, the error
+ is returned instead, and the rules of the object are to be left as they are.
+ Skipped objects have no rules and get no result, so their status is left alone.
+*/
+func (self *ObjectRuleController) rulesFromObject(s *ruleSync, pass *renderPass, obj runtime.Object) ([]elastalertRule, error) {
+	if self.kind.skipped(obj) {
+		return nil, nil
+	}
+	ruleList, errs := rulesFromObject(self.kind, obj, pass)
+	for _, err := range errs {
+		if isSecretUnavailable(err) {
+			return nil, err
+		}
+	}
+
+	origin := self.kind.origin(obj)
+	s.result(origin)
+	for _, err := range errs {
+		s.fail(origin, err)
+		rulesRejected.WithLabelValues(origin.Kind, origin.Namespace).Inc()
+	}
+	return ruleList, nil
+}
+
+func rulesFromObject(kind *objectKind, obj runtime.Object, pass *renderPass) ([]elastalertRule, []error) {
+	m := objectMeta(obj)
+	name := m.GetName()
+	log.Printf("Processing %s - %s/%s\n", kind.kind, m.GetNamespace(), name)
+
+	origin := kind.origin(obj)
+
+	context := templateContext{
+		Kind:        kind.kind,
+		Name:        name,
+		Namespace:   m.GetNamespace(),
+		Labels:      m.GetLabels(),
+		Annotations: m.GetAnnotations(),
+	}
+	if kind.templateSelector != nil {
+		context.Selector = kind.templateSelector(obj)
+	}
+
+	docs := kind.documents(obj)
+	keys := make([]string, 0, len(docs))
+	for k := range docs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ruleList []elastalertRule
+	var errs []error
+	for _, k := range keys {
+		v, err := renderRuleTemplate(k, docs[k], context)
+		if err != nil {
+			log.Printf("Unable to render elastalert rule template for %s %s. Error: %s. Skipping rule.\n", kind.source, name, err)
+			errs = append(errs, fmt.Errorf("Unable to render %s %s. Error: %s", kind.document, k, err))
+			continue
+		}
+		rules, err := parseRules(v)
+		if err != nil {
+			log.Printf("Unable to unmarshal elastalert rule for %s %s. Error: %s; Rule: %s. Skipping rule.\n", kind.source, name, err, v)
+			errs = append(errs, fmt.Errorf("Unable to unmarshal %s %s. Error: %s", kind.document, k, err))
+			continue
+		}
+		rendered, renderErrs := pass.render(rules, context)
+		for _, err := range renderErrs {
+			log.Printf("Skipping elastalert rule of %s %s. Error: %s\n", kind.source, name, err)
+		}
+		errs = append(errs, renderErrs...)
+		for _, rule := range rendered {
+			rule.origin = origin
+			ruleList = append(ruleList, rule)
+		}
+	}
+	return ruleList, errs
+}
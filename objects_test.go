@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+func TestSkippedObjectsGetNoStatus(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	kubeClient, err := kclient.New(&restclient.Config{Host: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := NewStatusReporter(kubeClient, testStatusKey, nil)
+	controller := &ObjectRuleController{
+		kind:   replicaSetKind(kubeClient),
+		store:  kcache.NewStore(kcache.MetaNamespaceKeyFunc),
+		status: status,
+	}
+
+	// a replica set of a deployment, with the annotations copied from it
+	replicaSet := &extensions.ReplicaSet{ObjectMeta: kapi.ObjectMeta{
+		Name: "frontend-1", Namespace: "default", UID: "1",
+		Annotations: map[string]string{
+			deploymentRevisionAnnotation:     "1",
+			"nordstrom.net/elastalertAlerts": "name: error-rate\ntype: any\nindex: logs-*\nalert: debug",
+			testStatusKey:                    `{"state": "loaded", "files": ["default_frontend_error-rate.deployment.yaml"]}`,
+		},
+	}}
+	controller.store.Add(replicaSet)
+
+	s, err := beginRuleSync(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := controller.rulesFromObject(s, nil, replicaSet)
+	if err != nil || len(rules) != 0 {
+		t.Errorf("Got rules %v and error %v from a skipped replica set", rules, err)
+	}
+	if len(s.results) != 0 {
+		t.Errorf("Recorded a result for a skipped replica set: %v", s.results)
+	}
+
+	// adopted by a deployment after the sync read it
+	s.result(controller.kind.origin(replicaSet))
+	controller.Committed(s)
+	if len(status.pending) != 0 {
+		t.Errorf("Reported a status onto a skipped replica set: %v", status.pending)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util"
+	"k8s.io/kubernetes/pkg/util/flowcontrol"
+)
+
+/*
+ A queue of object keys waiting to be reconciled. A key added several times before
+ it is processed is only processed once, and keys that fail are re-added with a
+ per-key exponential backoff. Draining is throttled by a token bucket so bursts of
+ events cannot flood the rules directory; notify is called whenever keys become
+ ready to drain.
+*/
+type RateLimitedQueue struct {
+	mutex        *sync.Mutex
+	queue        []string
+	dirty        map[string]bool
+	shuttingDown bool
+	notify       func()
+
+	qps     float32
+	limiter flowcontrol.RateLimiter
+	backoff *util.Backoff
+}
+
+func NewRateLimitedQueue(qps float32, burst int, initialBackoff, maxBackoff time.Duration, notify func()) *RateLimitedQueue {
+	return &RateLimitedQueue{
+		mutex:   &sync.Mutex{},
+		dirty:   map[string]bool{},
+		notify:  notify,
+		qps:     qps,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(qps, burst),
+		backoff: util.NewBackOff(initialBackoff, maxBackoff),
+	}
+}
+
+func (self *RateLimitedQueue) Add(key string) {
+	self.mutex.Lock()
+	if self.shuttingDown || self.dirty[key] {
+		self.mutex.Unlock()
+		return
+	}
+	self.dirty[key] = true
+	self.queue = append(self.queue, key)
+	self.mutex.Unlock()
+
+	self.notify()
+}
+
+// AddRateLimited re-adds a key once its backoff has expired.
+func (self *RateLimitedQueue) AddRateLimited(key string) {
+	self.backoff.Next(key, time.Now())
+	time.AfterFunc(self.backoff.Get(key), func() {
+		self.Add(key)
+	})
+}
+
+// Forget clears the backoff of a key after it was processed successfully.
+func (self *RateLimitedQueue) Forget(key string) {
+	self.backoff.Reset(key)
+}
+
+// Drain removes and returns every queued key, up to what the rate limiter allows.
+// Keys left behind are announced through notify once the limiter has refilled.
+func (self *RateLimitedQueue) Drain() []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var keys []string
+	for len(self.queue) > 0 && self.limiter.TryAccept() {
+		key := self.queue[0]
+		self.queue = self.queue[1:]
+		delete(self.dirty, key)
+		keys = append(keys, key)
+	}
+
+	if len(self.queue) > 0 {
+		time.AfterFunc(time.Duration(float32(time.Second)/self.qps), self.notify)
+	}
+	return keys
+}
+
+func (self *RateLimitedQueue) ShutDown() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.shuttingDown = true
+	self.queue = nil
+	self.dirty = map[string]bool{}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/*
+ Something that contributes rules to the rules directory. A source collects changes
+ from its own goroutines and only applies them when the reconciler asks it to.
+*/
+type RuleSource interface {
+	// Sync reconciles everything that changed since the last call into the sync.
+	Sync(sync *ruleSync)
+	// Resync marks every rule of the source as changed.
+	Resync()
+}
+
+// Implemented by sources that read their initial contents asynchronously.
+type SyncedSource interface {
+	// HasSynced reports whether the next sync covers the initial contents.
+	HasSynced() bool
+}
+
+// Implemented by sources that report the outcome of a sync back to where their
+// rules came from. Committed is only called once the sync reached the rules directory.
+type SyncObserver interface {
+	Committed(sync *ruleSync)
+}
+
+/*
+ Runs every sync of the rules directory from a single goroutine. Sources signal
+ that they are dirty; the reconciler waits until no signal arrived for the quiet
+ period, or the maximum delay passed since the first pending signal, and then runs
+ one sync covering all sources.
+*/
+type Reconciler struct {
+	rulesLocation string
+	quietPeriod   time.Duration
+	maxDelay      time.Duration
+	sources       []RuleSource
+	signal        chan struct{}
+	health        *HealthChecker
+	leader        *LeaderElector
+	// closed once Run returned
+	done chan struct{}
+}
+
+// NewReconciler creates a reconciler. health may be nil, and without a leader
+// elector every sync is written.
+func NewReconciler(rulesLocation string, quietPeriod, maxDelay time.Duration, health *HealthChecker, leader *LeaderElector) *Reconciler {
+	return &Reconciler{
+		rulesLocation: rulesLocation,
+		quietPeriod:   quietPeriod,
+		maxDelay:      maxDelay,
+		signal:        make(chan struct{}, 1),
+		health:        health,
+		leader:        leader,
+		done:          make(chan struct{}),
+	}
+}
+
+func (self *Reconciler) AddSource(source RuleSource) {
+	self.sources = append(self.sources, source)
+}
+
+// Signal requests a sync. It never blocks, signals sent while a sync is
+// pending are coalesced into it.
+func (self *Reconciler) Signal() {
+	select {
+	case self.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Resync marks every rule of every source as changed and requests a sync.
+func (self *Reconciler) Resync() {
+	for _, source := range self.sources {
+		source.Resync()
+	}
+	self.Signal()
+}
+
+// Run syncs until stopCh closes. A sync in flight is finished first.
+func (self *Reconciler) Run(stopCh <-chan struct{}) {
+	defer close(self.done)
+	resync := time.NewTicker(resyncPeriod)
+	defer resync.Stop()
+
+	for {
+		select {
+		case <-self.signal:
+		case <-resync.C:
+			for _, source := range self.sources {
+				source.Resync()
+			}
+		case <-stopCh:
+			return
+		}
+
+		if !self.debounce(stopCh) {
+			return
+		}
+		self.sync()
+	}
+}
+
+// Done is closed once Run returned, so no sync is in flight.
+func (self *Reconciler) Done() <-chan struct{} {
+	return self.done
+}
+
+// debounce waits for the sources to go quiet. It returns false if stopCh closed.
+func (self *Reconciler) debounce(stopCh <-chan struct{}) bool {
+	deadline := time.After(self.maxDelay)
+	quiet := time.NewTimer(self.quietPeriod)
+	defer func() { quiet.Stop() }()
+
+	for {
+		select {
+		case <-self.signal:
+			quiet.Stop()
+			quiet = time.NewTimer(self.quietPeriod)
+		case <-quiet.C:
+			return true
+		case <-deadline:
+			return true
+		case <-stopCh:
+			return false
+		}
+	}
+}
+
+func (self *Reconciler) sync() {
+	initial := self.sourcesSynced()
+	if !self.leader.IsLeader() {
+		// Followers keep their caches warm and leave the rules directory to the
+		// leader. A follower that takes over resyncs every source.
+		self.health.Synced(initial)
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		syncDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	s, err := beginRuleSync(self.rulesLocation)
+	if err != nil {
+		log.Printf("Unable to start rule sync. Error: %s\n", err)
+		self.retry()
+		return
+	}
+
+	for _, source := range self.sources {
+		source.Sync(s)
+	}
+
+	if err := s.commit(); err != nil {
+		log.Printf("Unable to commit rule sync. Error: %s\n", err)
+		self.retry()
+		return
+	}
+	lastSuccessfulSync.Set(float64(time.Now().Unix()))
+	self.health.Synced(initial)
+
+	for _, source := range self.sources {
+		if observer, ok := source.(SyncObserver); ok {
+			observer.Committed(s)
+		}
+	}
+
+	if s.needsResync() {
+		self.Resync()
+	}
+}
+
+// sourcesSynced reports whether every source has read its initial contents.
+func (self *Reconciler) sourcesSynced() bool {
+	for _, source := range self.sources {
+		if synced, ok := source.(SyncedSource); ok && !synced.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// retry resyncs every source after a delay, since nothing of the failed sync
+// may have reached the rules directory.
+func (self *Reconciler) retry() {
+	for _, source := range self.sources {
+		source.Resync()
+	}
+	time.AfterFunc(syncRetryDelay, self.Signal)
+}
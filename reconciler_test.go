@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ A source whose sync blocks until release is closed, and then writes a single rule.
+ started is closed once its first sync began.
+*/
+type blockingSource struct {
+	started chan struct{}
+	release chan struct{}
+	once    *sync.Once
+}
+
+func newBlockingSource() *blockingSource {
+	return &blockingSource{started: make(chan struct{}), release: make(chan struct{}), once: &sync.Once{}}
+}
+
+func (self *blockingSource) Sync(s *ruleSync) {
+	self.once.Do(func() { close(self.started) })
+	<-self.release
+	s.reconcile(ownsKind(sourceService), []elastalertRule{testRule(sourceService, "default", "frontend", "error-rate")})
+}
+
+func (self *blockingSource) Resync() {}
+
+// startReconciler runs a reconciler over a blocking source until its first sync began.
+func startReconciler(t *testing.T, rules string, stopCh chan struct{}) (*Reconciler, *blockingSource) {
+	source := newBlockingSource()
+	reconciler := NewReconciler(rules, time.Millisecond, 10*time.Millisecond, nil, nil)
+	reconciler.AddSource(source)
+	go reconciler.Run(stopCh)
+	reconciler.Signal()
+
+	select {
+	case <-source.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The sync did not start")
+	}
+	return reconciler, source
+}
+
+func TestReconcilerStopsWithoutSync(t *testing.T) {
+	reconciler := NewReconciler(os.TempDir(), time.Millisecond, 10*time.Millisecond, nil, nil)
+	stopCh := make(chan struct{})
+	go reconciler.Run(stopCh)
+	close(stopCh)
+
+	select {
+	case <-reconciler.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after stopCh closed")
+	}
+}
+
+func TestReconcilerFinishesSyncInFlight(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	stopCh := make(chan struct{})
+	reconciler, source := startReconciler(t, dir, stopCh)
+	close(stopCh)
+
+	select {
+	case <-reconciler.Done():
+		t.Fatal("Run returned while a sync was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(source.release)
+	select {
+	case <-reconciler.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the sync finished")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "default_frontend_error-rate.service.yaml")); err != nil {
+		t.Errorf("The sync in flight was not committed: %s", err)
+	}
+}
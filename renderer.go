@@ -0,0 +1,91 @@
+package main
+
+import (
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+/*
+ Turns the rules read from an object into elastalert rules: expands library
+ templates, applies the defaults, the discovered Alertmanager and the namespace
+ profiles, and resolves secrets from the namespace of the object.
+*/
+type RuleRenderer struct {
+	kubeClient   *kclient.Client
+	secrets      labels.Selector
+	defaults     *DefaultsManager
+	templates    *TemplateLibrary
+	namespaces   *NamespaceCache
+	alertmanager *AlertmanagerDiscovery
+}
+
+// NewRuleRenderer creates a renderer. templates and alertmanager may be nil.
+func NewRuleRenderer(kubeClient *kclient.Client, secrets labels.Selector, defaults *DefaultsManager, templates *TemplateLibrary, namespaces *NamespaceCache, alertmanager *AlertmanagerDiscovery) *RuleRenderer {
+	return &RuleRenderer{
+		kubeClient:   kubeClient,
+		secrets:      secrets,
+		defaults:     defaults,
+		templates:    templates,
+		namespaces:   namespaces,
+		alertmanager: alertmanager,
+	}
+}
+
+// HasSynced reports whether everything rules are rendered with has been read.
+func (self *RuleRenderer) HasSynced() bool {
+	return self.namespaces.HasSynced() && self.alertmanager.HasSynced()
+}
+
+// begin starts rendering the rules of one sync with the defaults in effect now.
+func (self *RuleRenderer) begin() *renderPass {
+	defaults := self.defaults.Get()
+	if url := self.alertmanager.URL(); url != nil {
+		// below the defaults file, profiles and rules, which may set their own
+		defaults = defaults.withDefault("alertmanager_url", url)
+	}
+
+	pass := &renderPass{defaults: defaults, templates: self.templates, namespaces: self.namespaces}
+	if self.kubeClient != nil {
+		pass.secrets = NewSecretCache(self.kubeClient, self.secrets)
+	}
+	return pass
+}
+
+/*
+ Renders the rules of a single sync, so every rule of the sync sees the same
+ defaults and each secret is only read once.
+*/
+type renderPass struct {
+	defaults   *RuleDefaults
+	templates  *TemplateLibrary
+	namespaces *NamespaceCache
+	secrets    *SecretCache
+}
+
+// render returns the rules that rendered, and an error for every rule that did not.
+func (self *renderPass) render(rules []map[string]interface{}, context templateContext) ([]elastalertRule, []error) {
+	defaults := self.defaults
+	if context.Namespace != "" {
+		defaults = self.namespaces.DefaultsFor(defaults, context.Namespace)
+	}
+	lookup := self.secrets.lookup(context.Namespace)
+
+	var ruleList []elastalertRule
+	var errs []error
+	for _, ref := range rules {
+		expanded, err := self.templates.expand(ref, context)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rule := range expanded {
+			erule, err := processRule(rule, defaults, lookup)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			ruleList = append(ruleList, erule)
+		}
+	}
+	return ruleList, errs
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// The ElastalertRule resource, served by a ThirdPartyResource named
+// elastalert-rule.nordstrom.net or a CustomResourceDefinition named
+// elastalertrules.nordstrom.net, which both use the same API path.
+const (
+	ruleResourceKind     = "ElastalertRule"
+	ruleResourceResource = "elastalertrules"
+)
+
+var ruleResourceGroupVersion = unversioned.GroupVersion{Group: "nordstrom.net", Version: "v1"}
+
+/*
+ An alert rule as an API object. The spec is the rule itself, in the same form as a
+ rule annotation, and its name defaults to the name of the object. The loader writes
+ the outcome of loading the rule into the status.
+*/
+type ElastalertRule struct {
+	unversioned.TypeMeta `json:",inline"`
+	kapi.ObjectMeta      `json:"metadata,omitempty"`
+
+	Spec   json.RawMessage `json:"spec,omitempty"`
+	Status *ruleStatus     `json:"status,omitempty"`
+}
+
+func (self *ElastalertRule) GetObjectKind() unversioned.ObjectKind {
+	return &self.TypeMeta
+}
+
+func (self *ElastalertRule) getRuleStatus() *ruleStatus {
+	return self.Status
+}
+
+type ElastalertRuleList struct {
+	unversioned.TypeMeta `json:",inline"`
+	unversioned.ListMeta `json:"metadata,omitempty"`
+
+	Items []ElastalertRule `json:"items"`
+}
+
+func (self *ElastalertRuleList) GetObjectKind() unversioned.ObjectKind {
+	return &self.TypeMeta
+}
+
+/*
+ Encodes and decodes ElastalertRule objects as plain JSON. Third party groups are
+ not part of the client's scheme, so the codecs of the other clients cannot be used.
+*/
+type ruleResourceCodec struct{}
+
+func (ruleResourceCodec) EncodeToStream(obj runtime.Object, stream io.Writer, overrides ...unversioned.GroupVersion) error {
+	return json.NewEncoder(stream).Encode(obj)
+}
+
+// Decode decodes into a rule, a list of rules, or the status of a failed request.
+func (ruleResourceCodec) Decode(data []byte, defaults *unversioned.GroupVersionKind, into runtime.Object) (runtime.Object, *unversioned.GroupVersionKind, error) {
+	var probe struct {
+		unversioned.TypeMeta `json:",inline"`
+		Items                json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, nil, err
+	}
+	gvk := unversioned.FromAPIVersionAndKind(probe.APIVersion, probe.Kind)
+
+	if into == nil {
+		switch {
+		case probe.Kind == "Status":
+			into = &unversioned.Status{}
+		case probe.Items != nil:
+			into = &ElastalertRuleList{}
+		default:
+			into = &ElastalertRule{}
+		}
+	}
+	if err := json.Unmarshal(data, into); err != nil {
+		return nil, gvk, err
+	}
+	return into, gvk, nil
+}
+
+// NewRuleResourceClient creates a client for the ElastalertRule API group.
+func NewRuleResourceClient(config *restclient.Config) (*restclient.RESTClient, error) {
+	groupConfig := *config
+	groupConfig.APIPath = "/apis"
+	groupConfig.GroupVersion = &ruleResourceGroupVersion
+	groupConfig.Codec = ruleResourceCodec{}
+	if groupConfig.UserAgent == "" {
+		groupConfig.UserAgent = restclient.DefaultKubernetesUserAgent()
+	}
+	return restclient.RESTClientFor(&groupConfig)
+}
+
+// elastalertRuleKind reads the rule in the spec of every ElastalertRule.
+func elastalertRuleKind(client *restclient.RESTClient) *objectKind {
+	return &objectKind{
+		source:     sourceRuleResource,
+		kind:       ruleResourceKind,
+		apiVersion: ruleResourceGroupVersion.String(),
+		resource:   ruleResourceResource,
+		client:     client,
+		rawParams:  true,
+		selector:   labels.Everything(),
+		newObject:  func() runtime.Object { return &ElastalertRule{} },
+		document:   "rule",
+		documents:  ruleResourceDocuments,
+	}
+}
+
+func ruleResourceDocuments(obj runtime.Object) map[string]string {
+	rule := obj.(*ElastalertRule)
+	spec := string(rule.Spec)
+
+	var options map[string]interface{}
+	if err := json.Unmarshal(rule.Spec, &options); err == nil && options != nil {
+		if _, ok := options["name"]; !ok {
+			options["name"] = rule.Name
+			if data, err := json.Marshal(options); err == nil {
+				spec = string(data)
+			}
+		}
+	}
+	// JSON is YAML, so the spec is read like any other rule
+	return map[string]string{"spec": spec}
+}
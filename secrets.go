@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// An option value of {secretKeyRef: {name: ..., key: ...}} is replaced with the
+// value of the key in the named secret, like an environment variable of a pod.
+const secretKeyRef = "secretKeyRef"
+
+// Looks up the value of a key of a secret in the namespace of the rule being rendered.
+type secretLookup func(name, key string) (string, error)
+
+/*
+ A secret that could not be read for any reason but not existing, such as a timeout
+ of the API server. The rules of an object that refer to it are left as they are
+ until the secret can be read, rather than being rejected.
+*/
+type secretUnavailableError struct {
+	err error
+}
+
+func (self *secretUnavailableError) Error() string {
+	return self.err.Error()
+}
+
+func isSecretUnavailable(err error) bool {
+	_, ok := err.(*secretUnavailableError)
+	return ok
+}
+
+// wrapSecretError formats a new error that is still unavailable if err was.
+func wrapSecretError(err error, format string, args ...interface{}) error {
+	wrapped := fmt.Errorf(format, args...)
+	if isSecretUnavailable(err) {
+		return &secretUnavailableError{wrapped}
+	}
+	return wrapped
+}
+
+// secretRef returns the secret a placeholder refers to. ok is false for any other value.
+func secretRef(value interface{}) (name, key string, ok bool, err error) {
+	m, isMap := value.(map[interface{}]interface{})
+	if !isMap {
+		return "", "", false, nil
+	}
+	ref, found := m[secretKeyRef]
+	if !found {
+		return "", "", false, nil
+	}
+
+	refMap, isMap := ref.(map[interface{}]interface{})
+	if isMap {
+		name, _ = refMap["name"].(string)
+		key, _ = refMap["key"].(string)
+	}
+	if len(m) != 1 || name == "" || key == "" {
+		return "", "", false, fmt.Errorf("%s must only hold the name and key of a secret", secretKeyRef)
+	}
+	return name, key, true, nil
+}
+
+// isSecretRef reports whether value is a placeholder, whose value is not validated.
+func isSecretRef(value interface{}) bool {
+	_, _, ok, _ := secretRef(value)
+	return ok
+}
+
+/*
+ Replaces every placeholder in a rule with the value of the secret it refers to,
+ and reports whether there were any. Without a lookup placeholders are an error.
+*/
+func resolveRuleSecrets(ruleMap map[string]interface{}, lookup secretLookup) (bool, error) {
+	found := false
+	for option, value := range ruleMap {
+		resolved, ok, err := resolveSecrets(value, lookup)
+		if err != nil {
+			return false, wrapSecretError(err, "%s: %s", option, err)
+		}
+		ruleMap[option] = resolved
+		found = found || ok
+	}
+	return found, nil
+}
+
+func resolveSecrets(value interface{}, lookup secretLookup) (interface{}, bool, error) {
+	name, key, ok, err := secretRef(value)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		if lookup == nil {
+			return nil, false, fmt.Errorf("%s is only supported in rules of namespaced objects", secretKeyRef)
+		}
+		secret, err := lookup(name, key)
+		return secret, true, err
+	}
+
+	found := false
+	switch value := value.(type) {
+	case []interface{}:
+		for i, item := range value {
+			resolved, ok, err := resolveSecrets(item, lookup)
+			if err != nil {
+				return nil, false, err
+			}
+			value[i] = resolved
+			found = found || ok
+		}
+	case map[interface{}]interface{}:
+		for k, item := range value {
+			resolved, ok, err := resolveSecrets(item, lookup)
+			if err != nil {
+				return nil, false, err
+			}
+			value[k] = resolved
+			found = found || ok
+		}
+	}
+	return value, found, nil
+}
+
+/*
+ Reads the secrets rules refer to. A cache lives for a single sync, so a secret
+ shared by many rules is only fetched once per sync and changes to it are picked
+ up by the next one. Only secrets matching the selector can be read, so being able
+ to annotate a service does not grant reading every secret of its namespace.
+*/
+type SecretCache struct {
+	kubeClient *kclient.Client
+	selector   labels.Selector
+	secrets    map[string]*kapi.Secret
+	errors     map[string]error
+}
+
+func NewSecretCache(kubeClient *kclient.Client, selector labels.Selector) *SecretCache {
+	return &SecretCache{
+		kubeClient: kubeClient,
+		selector:   selector,
+		secrets:    map[string]*kapi.Secret{},
+		errors:     map[string]error{},
+	}
+}
+
+// lookup returns a lookup confined to the secrets of one namespace.
+func (self *SecretCache) lookup(namespace string) secretLookup {
+	if self == nil || namespace == "" {
+		return nil
+	}
+	return func(name, key string) (string, error) {
+		secret, err := self.get(namespace, name)
+		if err != nil {
+			return "", err
+		}
+		value, ok := secret.Data[key]
+		if !ok {
+			return "", fmt.Errorf("Secret %s/%s has no key %q", namespace, name, key)
+		}
+		return string(value), nil
+	}
+}
+
+func (self *SecretCache) get(namespace, name string) (*kapi.Secret, error) {
+	cacheKey := namespace + "/" + name
+	if secret, ok := self.secrets[cacheKey]; ok {
+		return secret, nil
+	}
+	if err, ok := self.errors[cacheKey]; ok {
+		return nil, err
+	}
+
+	secret, err := self.kubeClient.Secrets(namespace).Get(name)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			err = fmt.Errorf("Secret %s does not exist", cacheKey)
+		} else {
+			err = &secretUnavailableError{fmt.Errorf("Unable to read secret %s. Error: %s", cacheKey, err)}
+		}
+		self.errors[cacheKey] = err
+		return nil, err
+	}
+	if !self.selector.Matches(labels.Set(secret.Labels)) {
+		err = fmt.Errorf("Secret %s does not match %s and cannot be used by rules", cacheKey, self.selector)
+		self.errors[cacheKey] = err
+		return nil, err
+	}
+	self.secrets[cacheKey] = secret
+	return secret, nil
+}
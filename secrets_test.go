@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+func TestSecretCacheErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/namespaces/default/secrets/slack":
+			w.Write([]byte(`{"kind": "Secret", "apiVersion": "v1", "metadata": {"name": "slack", "namespace": "default", "labels": {"elastalert-secrets": "true"}}, "data": {"url": "aHR0cDovL3NsYWNr"}}`))
+		case "/api/v1/namespaces/default/secrets/database":
+			w.Write([]byte(`{"kind": "Secret", "apiVersion": "v1", "metadata": {"name": "database", "namespace": "default"}, "data": {"password": "aHVudGVyMg=="}}`))
+		case "/api/v1/namespaces/default/secrets/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "InternalError", "code": 500}`))
+		}
+	}))
+	defer server.Close()
+
+	kubeClient, err := kclient.New(&restclient.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := NewSecretCache(kubeClient, labels.SelectorFromSet(labels.Set{"elastalert-secrets": "true"})).lookup("default")
+
+	tests := []struct {
+		name, key   string
+		value       string
+		rejected    bool
+		unavailable bool
+	}{
+		{"slack", "url", "http://slack", false, false},
+		{"slack", "token", "", true, false},
+		{"missing", "url", "", true, false},
+		{"database", "password", "", true, false},
+		{"broken", "url", "", false, true},
+	}
+
+	for _, test := range tests {
+		value, err := lookup(test.name, test.key)
+		if value != test.value {
+			t.Errorf("%s/%s: got %q, expected %q", test.name, test.key, value, test.value)
+		}
+		if (err != nil) != (test.rejected || test.unavailable) {
+			t.Errorf("%s/%s: unexpected error %v", test.name, test.key, err)
+		}
+		if isSecretUnavailable(err) != test.unavailable {
+			t.Errorf("%s/%s: error %v unavailable %v, expected %v", test.name, test.key, err, isSecretUnavailable(err), test.unavailable)
+		}
+	}
+}
+
+func TestResolveRuleSecretsUnavailable(t *testing.T) {
+	lookup := func(name, key string) (string, error) {
+		return "", &secretUnavailableError{errors.New("timeout")}
+	}
+	rule := map[string]interface{}{
+		"slack_webhook_url": map[interface{}]interface{}{
+			secretKeyRef: map[interface{}]interface{}{"name": "slack", "key": "url"},
+		},
+	}
+	if _, err := resolveRuleSecrets(rule, lookup); !isSecretUnavailable(err) {
+		t.Errorf("Got %v, expected an unavailable secret", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// serviceKind reads rules from the annotations of every service.
+func serviceKind(kubeClient *kclient.Client) *objectKind {
+	kind := annotatedKind(sourceService, "Service", "v1", "services", kubeClient.RESTClient, func() runtime.Object { return &kapi.Service{} })
+	kind.templateSelector = func(obj runtime.Object) map[string]string {
+		return obj.(*kapi.Service).Spec.Selector
+	}
+	return kind
+}
+
+// annotatedKind reads rules from the annotations of every object of a resource.
+func annotatedKind(source, kind, apiVersion, resource string, client *restclient.RESTClient, newObject func() runtime.Object) *objectKind {
+	return &objectKind{
+		source:     source,
+		kind:       kind,
+		apiVersion: apiVersion,
+		resource:   resource,
+		client:     client,
+		selector:   labels.Everything(),
+		newObject:  newObject,
+		document:   "annotation",
+		documents:  annotationDocuments,
+	}
+}
+
+// annotationDocuments returns the annotations of an object that hold rules.
+func annotationDocuments(obj runtime.Object) map[string]string {
+	anno := objectMeta(obj).GetAnnotations()
+	docs := map[string]string{}
+	for _, k := range ruleAnnotationKeys(anno) {
+		docs[k] = anno[k]
+	}
+	return docs
+}
+
+// ruleAnnotationKeys returns, in a stable order, the annotation keys holding rules.
+func ruleAnnotationKeys(anno map[string]string) []string {
+	var keys []string
+	for k := range anno {
+		if k == *statusAnnotationKey {
+			continue
+		}
+		if k == *annotationKey || (*annotationPrefix != "" && strings.HasPrefix(k, *annotationPrefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
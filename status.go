@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/flowcontrol"
+)
+
+const (
+	statusLoaded   = "loaded"
+	statusRejected = "rejected"
+	// Source of the events the loader emits.
+	eventComponent = "elastalert-rule-loader"
+)
+
+/*
+ The outcome of loading the rules of an object, written as JSON into its status
+ annotation. The state is rejected as soon as one rule was rejected; Files still
+ lists the rules that were loaded. LastSync is the time of the sync that last
+ changed the status.
+*/
+type ruleStatus struct {
+	State    string   `json:"state"`
+	Files    []string `json:"files,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	LastSync string   `json:"lastSync"`
+}
+
+// newRuleStatus returns nil for an object without rules, whose status annotation
+// is removed.
+func newRuleStatus(result *ruleResult, now time.Time) *ruleStatus {
+	if len(result.files) == 0 && len(result.errors) == 0 {
+		return nil
+	}
+
+	status := &ruleStatus{
+		State:    statusLoaded,
+		Files:    append([]string{}, result.files...),
+		LastSync: now.UTC().Format(time.RFC3339),
+	}
+	sort.Strings(status.Files)
+	if len(result.errors) > 0 {
+		status.State = statusRejected
+		status.Error = strings.Join(result.errors, "; ")
+	}
+	return status
+}
+
+// parseRuleStatus reads a status annotation, returning nil if it cannot be read.
+func parseRuleStatus(value string) *ruleStatus {
+	if value == "" {
+		return nil
+	}
+	status := &ruleStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil
+	}
+	return status
+}
+
+// sameAs compares two statuses, ignoring when they were written.
+func (self *ruleStatus) sameAs(other *ruleStatus) bool {
+	if self == nil || other == nil {
+		return self == other
+	}
+	return self.State == other.State && self.Error == other.Error && strings.Join(self.Files, "\n") == strings.Join(other.Files, "\n")
+}
+
+type statusUpdate struct {
+	kind   *objectKind
+	origin ruleOrigin
+	status *ruleStatus
+}
+
+/*
+ Writes the rule status of objects into their status annotation, and emits an event
+ against an object whenever its status changes. Updates are applied from a single
+ goroutine and throttled, so a full sync does not flood the API server; only the
+ latest status of an object is kept while it waits.
+*/
+type StatusReporter struct {
+	kubeClient    *kclient.Client
+	annotationKey string
+	leader        *LeaderElector
+	limiter       flowcontrol.RateLimiter
+
+	mutex   *sync.Mutex
+	pending map[string]statusUpdate
+	order   []string
+	signal  chan struct{}
+	// held while updates are applied, so Run and Flush never apply the same update
+	applyMutex *sync.Mutex
+}
+
+// NewStatusReporter creates a reporter. Without a leader elector every update is applied.
+func NewStatusReporter(kubeClient *kclient.Client, annotationKey string, leader *LeaderElector) *StatusReporter {
+	return &StatusReporter{
+		kubeClient:    kubeClient,
+		annotationKey: annotationKey,
+		leader:        leader,
+		limiter:       flowcontrol.NewTokenBucketRateLimiter(statusQPS, statusBurst),
+		mutex:         &sync.Mutex{},
+		pending:       map[string]statusUpdate{},
+		signal:        make(chan struct{}, 1),
+		applyMutex:    &sync.Mutex{},
+	}
+}
+
+/*
+ Queues the status of an object, given the object as it is now. Nothing is queued if
+ the object already holds the same status: every update comes back as a watch event
+ and a sync of the object, so rewriting an unchanged status on each full resync would
+ keep the API server busy for nothing.
+*/
+func (self *StatusReporter) Report(kind *objectKind, origin ruleOrigin, obj runtime.Object, result *ruleResult) {
+	status := newRuleStatus(result, time.Now())
+	current, present := self.currentStatus(obj)
+	if status == nil {
+		if !present {
+			return
+		}
+	} else if current != nil && status.sameAs(current) {
+		return
+	}
+
+	key := fmt.Sprintf("%s/%s/%s", origin.Kind, origin.Namespace, origin.Name)
+	self.mutex.Lock()
+	if _, ok := self.pending[key]; !ok {
+		self.order = append(self.order, key)
+	}
+	self.pending[key] = statusUpdate{kind: kind, origin: origin, status: status}
+	self.mutex.Unlock()
+
+	select {
+	case self.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (self *StatusReporter) Run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-self.signal:
+			self.Flush()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Flush applies every queued update before returning.
+func (self *StatusReporter) Flush() {
+	self.applyMutex.Lock()
+	defer self.applyMutex.Unlock()
+
+	for {
+		update, ok := self.next()
+		if !ok {
+			return
+		}
+		if !self.leader.IsLeader() {
+			// reported by the new leader after it resynced
+			continue
+		}
+		self.limiter.Accept()
+		if err := self.apply(update); err != nil {
+			// the next full sync queues the update again
+			log.Printf("Unable to update rule status of %s. Error: %s\n", update.origin, err)
+		}
+	}
+}
+
+func (self *StatusReporter) next() (statusUpdate, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if len(self.order) == 0 {
+		return statusUpdate{}, false
+	}
+	key := self.order[0]
+	self.order = self.order[1:]
+	update := self.pending[key]
+	delete(self.pending, key)
+	return update, true
+}
+
+/*
+ Writes a status onto an object with a merge patch that only touches the status.
+ Sending back the whole object would drop every field this client does not know
+ about, and could change the pod template of a workload.
+*/
+func (self *StatusReporter) apply(update statusUpdate) error {
+	kind, origin := update.kind, update.origin
+	obj := kind.newObject()
+	err := kind.client.Get().Namespace(origin.Namespace).Resource(kind.resource).Name(origin.Name).Do().Into(obj)
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(objectMeta(obj).GetUID()) != origin.UID {
+		// the object was replaced, its own sync reports on it
+		return nil
+	}
+
+	previous, present := self.currentStatus(obj)
+	if update.status == nil && !present {
+		return nil
+	}
+	if update.status != nil && update.status.sameAs(previous) {
+		// written in the meantime, e.g. by a previous leader
+		return nil
+	}
+
+	patch, err := self.statusPatch(obj, origin.UID, update.status)
+	if err != nil {
+		return err
+	}
+	updated := kind.newObject()
+	err = kind.client.Patch(kapi.MergePatchType).Namespace(origin.Namespace).Resource(kind.resource).Name(origin.Name).Body(patch).Do().Into(updated)
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if update.status != nil && !update.status.sameAs(previous) {
+		m := objectMeta(updated)
+		self.emitEvent(kapi.ObjectReference{
+			Kind:            kind.kind,
+			APIVersion:      kind.apiVersion,
+			Namespace:       m.GetNamespace(),
+			Name:            m.GetName(),
+			UID:             m.GetUID(),
+			ResourceVersion: m.GetResourceVersion(),
+		}, update.status)
+	}
+	return nil
+}
+
+// Implemented by objects that hold their rule status in a field of their own rather
+// than in the status annotation.
+type ruleStatusHolder interface {
+	getRuleStatus() *ruleStatus
+}
+
+// currentStatus returns the status an object holds, and whether it holds one at all.
+func (self *StatusReporter) currentStatus(obj runtime.Object) (*ruleStatus, bool) {
+	if holder, ok := obj.(ruleStatusHolder); ok {
+		status := holder.getRuleStatus()
+		return status, status != nil
+	}
+	value, present := objectMeta(obj).GetAnnotations()[self.annotationKey]
+	return parseRuleStatus(value), present
+}
+
+/*
+ Builds a merge patch that sets the status of an object, or removes it if status is
+ nil. The patch carries the UID of the object, so it is refused rather than applied
+ to an object that was replaced since it was read.
+*/
+func (self *StatusReporter) statusPatch(obj runtime.Object, uid string, status *ruleStatus) ([]byte, error) {
+	metadata := map[string]interface{}{"uid": uid}
+	patch := map[string]interface{}{"metadata": metadata}
+	if _, ok := obj.(ruleStatusHolder); ok {
+		patch["status"] = status
+		return json.Marshal(patch)
+	}
+
+	// null removes the annotation
+	var value interface{}
+	if status != nil {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return nil, err
+		}
+		value = string(data)
+	}
+	metadata["annotations"] = map[string]interface{}{self.annotationKey: value}
+	return json.Marshal(patch)
+}
+
+func (self *StatusReporter) emitEvent(ref kapi.ObjectReference, status *ruleStatus) {
+	reason, eventType := "RuleLoaded", kapi.EventTypeNormal
+	message := fmt.Sprintf("Loaded elastalert rules into %s", strings.Join(status.Files, ", "))
+	if status.State == statusRejected {
+		reason, eventType = "RuleRejected", kapi.EventTypeWarning
+		message = status.Error
+	}
+
+	now := unversioned.Now()
+	event := &kapi.Event{
+		ObjectMeta: kapi.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject: ref,
+		Reason:         reason,
+		Message:        message,
+		Source:         kapi.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	if _, err := self.kubeClient.Events(ref.Namespace).Create(event); err != nil {
+		log.Printf("Unable to create event for %s %s/%s. Error: %s\n", ref.Kind, ref.Namespace, ref.Name, err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+const testStatusKey = "nordstrom.net/elastalertAlertsStatus"
+
+/*
+ An API server holding a single ConfigMap, default/rules, that records the status
+ annotations patched onto it, "" for a removed one, and the patches themselves.
+ Patches wait until release is closed, if it is set.
+*/
+type fakeStatusServer struct {
+	*httptest.Server
+	release chan struct{}
+
+	mutex   *sync.Mutex
+	written []string
+	patches []map[string]interface{}
+}
+
+func newFakeStatusServer(release chan struct{}) *fakeStatusServer {
+	fake := &fakeStatusServer{release: release, mutex: &sync.Mutex{}}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+func (self *fakeStatusServer) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/v1/namespaces/default/configmaps/rules":
+		w.Write([]byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "rules", "namespace": "default", "uid": "1", "resourceVersion": "1"}}`))
+	case r.Method == "PATCH" && r.URL.Path == "/api/v1/namespaces/default/configmaps/rules":
+		if self.release != nil {
+			<-self.release
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != string(kapi.MergePatchType) {
+			http.Error(w, "unexpected patch type "+contentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var patch map[string]interface{}
+		var configMap struct {
+			Metadata struct {
+				Annotations map[string]*string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		json.Unmarshal(body, &patch)
+		json.Unmarshal(body, &configMap)
+		status := ""
+		if value := configMap.Metadata.Annotations[testStatusKey]; value != nil {
+			status = *value
+		}
+		self.mutex.Lock()
+		self.written = append(self.written, status)
+		self.patches = append(self.patches, patch)
+		self.mutex.Unlock()
+		w.Write([]byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "rules", "namespace": "default", "uid": "1", "resourceVersion": "2"}}`))
+	case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/default/events":
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (self *fakeStatusServer) statuses() []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]string{}, self.written...)
+}
+
+func (self *fakeStatusServer) statusPatches() []map[string]interface{} {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]map[string]interface{}{}, self.patches...)
+}
+
+// reportRulesStatus queues the status of default/rules having loaded one rule file.
+func reportRulesStatus(t *testing.T, server *fakeStatusServer) *StatusReporter {
+	kubeClient, err := kclient.New(&restclient.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := NewStatusReporter(kubeClient, testStatusKey, nil)
+
+	kind := configMapKind(kubeClient, labels.Everything())
+	obj := &kapi.ConfigMap{ObjectMeta: kapi.ObjectMeta{Name: "rules", Namespace: "default", UID: "1"}}
+	status.Report(kind, kind.origin(obj), obj, &ruleResult{files: []string{"default_rules_x.configmap-api.yaml"}})
+	return status
+}
+
+func TestStatusReporterFlush(t *testing.T) {
+	server := newFakeStatusServer(nil)
+	defer server.Close()
+
+	status := reportRulesStatus(t, server)
+	status.Flush()
+
+	written := server.statuses()
+	if len(written) != 1 {
+		t.Fatalf("Wrote %d statuses, expected 1", len(written))
+	}
+	if s := parseRuleStatus(written[0]); s == nil || s.State != statusLoaded || len(s.Files) != 1 {
+		t.Errorf("Wrote status %q", written[0])
+	}
+
+	// nothing is left to flush
+	status.Flush()
+	if len(server.statuses()) != 1 {
+		t.Errorf("Flushed the same status twice")
+	}
+}
+
+func TestStatusReporterSkipsUnchanged(t *testing.T) {
+	server := newFakeStatusServer(nil)
+	defer server.Close()
+	kubeClient, err := kclient.New(&restclient.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := NewStatusReporter(kubeClient, testStatusKey, nil)
+
+	kind := configMapKind(kubeClient, labels.Everything())
+	result := &ruleResult{files: []string{"default_rules_x.configmap-api.yaml"}}
+	current, _ := json.Marshal(&ruleStatus{State: statusLoaded, Files: result.files, LastSync: "2016-01-01T00:00:00Z"})
+	obj := &kapi.ConfigMap{ObjectMeta: kapi.ObjectMeta{
+		Name: "rules", Namespace: "default", UID: "1",
+		Annotations: map[string]string{testStatusKey: string(current)},
+	}}
+	status.Report(kind, kind.origin(obj), obj, result)
+	status.Flush()
+
+	if written := server.statuses(); len(written) != 0 {
+		t.Errorf("Rewrote an unchanged status: %v", written)
+	}
+}
+
+func TestStatusReporterPatchesOnlyTheStatus(t *testing.T) {
+	server := newFakeStatusServer(nil)
+	defer server.Close()
+
+	status := reportRulesStatus(t, server)
+	status.Flush()
+
+	patches := server.statusPatches()
+	if len(patches) != 1 {
+		t.Fatalf("Sent %d patches, expected 1", len(patches))
+	}
+	if len(patches[0]) != 1 {
+		t.Errorf("Patch touches more than the metadata: %v", patches[0])
+	}
+	metadata, _ := patches[0]["metadata"].(map[string]interface{})
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if len(metadata) != 2 || metadata["uid"] != "1" || len(annotations) != 1 {
+		t.Errorf("Patch touches more than the status annotation: %v", patches[0])
+	}
+}
+
+func TestStatusPatch(t *testing.T) {
+	status := NewStatusReporter(nil, testStatusKey, nil)
+	loaded := &ruleStatus{State: statusLoaded, Files: []string{"x.yaml"}}
+	tests := []struct {
+		obj      runtime.Object
+		status   *ruleStatus
+		expected string
+	}{
+		{&kapi.ConfigMap{}, nil, `{"metadata":{"annotations":{"` + testStatusKey + `":null},"uid":"1"}}`},
+		{&ElastalertRule{}, nil, `{"metadata":{"uid":"1"},"status":null}`},
+		{&ElastalertRule{}, loaded, `{"metadata":{"uid":"1"},"status":{"state":"loaded","files":["x.yaml"],"lastSync":""}}`},
+	}
+
+	for _, test := range tests {
+		patch, err := status.statusPatch(test.obj, "1", test.status)
+		if err != nil {
+			t.Errorf("statusPatch(%T, %v) failed: %s", test.obj, test.status, err)
+		} else if string(patch) != test.expected {
+			t.Errorf("statusPatch(%T, %v) = %s, expected %s", test.obj, test.status, patch, test.expected)
+		}
+	}
+
+	patch, _ := status.statusPatch(&kapi.ConfigMap{}, "1", loaded)
+	var decoded struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	json.Unmarshal(patch, &decoded)
+	if s := parseRuleStatus(decoded.Metadata.Annotations[testStatusKey]); s == nil || !s.sameAs(loaded) {
+		t.Errorf("statusPatch wrote annotation %q", decoded.Metadata.Annotations[testStatusKey])
+	}
+}
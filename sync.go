@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ Counts what a single sync did to the rules directory.
+*/
+type syncStats struct {
+	added     int
+	updated   int
+	removed   int
+	unchanged int
+	rejected  int
+}
+
+func (self syncStats) changed() bool {
+	return self.added+self.updated+self.removed > 0
+}
+
+func (self syncStats) String() string {
+	return fmt.Sprintf("%d added, %d updated, %d removed, %d unchanged, %d rejected", self.added, self.updated, self.removed, self.unchanged, self.rejected)
+}
+
+/*
+ What a sync did with the rules of one origin: the files holding its rules and
+ why any of its rules were rejected.
+*/
+type ruleResult struct {
+	files  []string
+	errors []string
+}
+
+/*
+ A single pass over the rules directory. Every source reconciles its rules into the
+ same sync, and the changes are committed together once all sources are done.
+*/
+type ruleSync struct {
+	rulesLocation  string
+	manifest       *RuleManifest
+	writer         RuleWriter
+	stats          syncStats
+	originsChanged bool
+	// rule names rejected as duplicates, and names of removed rules
+	duplicates map[string]bool
+	freed      map[string]bool
+	results    map[ruleOrigin]*ruleResult
+}
+
+func beginRuleSync(rulesLocation string) (*ruleSync, error) {
+	manifest, err := loadManifest(rulesLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := newRuleWriter(rulesLocation, *stagedWrites)
+	if err != nil {
+		return nil, err
+	}
+	return &ruleSync{
+		rulesLocation: rulesLocation,
+		manifest:      manifest,
+		writer:        writer,
+		duplicates:    map[string]bool{},
+		freed:         map[string]bool{},
+		results:       map[ruleOrigin]*ruleResult{},
+	}, nil
+}
+
+/*
+ Writes rules into the rules directory and removes every file the loader previously
+ wrote for an origin matched by owns that no longer produces a rule. Files missing
+ from the manifest are never overwritten or removed, and files whose content hash
+ matches the manifest are left untouched so elastalert does not reload them.
+
+ elastalert refuses to start when two rules share a name, so a rule whose name is
+ already used by a rule outside of owns, or earlier in rules, is rejected. Rules
+ that are already in the rules directory keep their name.
+*/
+func (self *ruleSync) reconcile(owns func(ruleOrigin) bool, rules []elastalertRule) error {
+	claimed := map[string]string{}
+	for filename, entry := range self.manifest.Rules {
+		if entry.RuleName != "" && !owns(entry.ruleOrigin) {
+			claimed[entry.RuleName] = filename
+		}
+	}
+
+	// Rules that are already written claim their names first, so a newly added
+	// duplicate never displaces a live rule.
+	ordered := make([]elastalertRule, 0, len(rules))
+	var added []elastalertRule
+	for _, rule := range rules {
+		if entry, ok := self.manifest.Rules[ruleFileName(rule)]; ok && entry.RuleName == rule.name {
+			ordered = append(ordered, rule)
+		} else {
+			added = append(added, rule)
+		}
+	}
+	ordered = append(ordered, added...)
+
+	var writeErr error
+	wanted := map[string]bool{}
+	for _, rule := range ordered {
+		filename := ruleFileName(rule)
+		hash := ruleHash(rule.rule)
+		if err := validateRuleFileName(filename); err != nil {
+			self.reject(rule, "%s", err)
+			continue
+		}
+		_, statErr := os.Lstat(filepath.Join(self.rulesLocation, filename))
+
+		if other, ok := claimed[rule.name]; ok && other != filename {
+			self.reject(rule, "rule name %q is already used by rule file %s", rule.name, other)
+			self.duplicates[rule.name] = true
+			continue
+		}
+		entry, owned := self.manifest.Rules[filename]
+		if !owned && statErr == nil {
+			self.reject(rule, "file %s exists and was not written by the loader", filename)
+			continue
+		}
+		if (owned && !owns(entry.ruleOrigin)) || wanted[filename] {
+			self.reject(rule, "file name %s is already used by another rule", filename)
+			continue
+		}
+		claimed[rule.name] = filename
+
+		// Keep the previous version of the file if the write fails.
+		wanted[filename] = true
+		newEntry := manifestEntry{ruleOrigin: rule.origin, RuleName: rule.name, Hash: hash}
+		if owned && entry.Hash == hash && statErr == nil {
+			// the origin may have been recreated with a new UID
+			if entry != newEntry {
+				self.manifest.Rules[filename] = newEntry
+				self.originsChanged = true
+			}
+			self.stats.unchanged++
+			self.loaded(rule, filename)
+			continue
+		}
+		if err := writeRule(rule, self.writer, filename); err != nil {
+			log.Printf("%s\n", err)
+			self.fail(rule.origin, err)
+			writeErr = err
+			continue
+		}
+		self.manifest.Rules[filename] = newEntry
+		self.loaded(rule, filename)
+		rulesLoaded.WithLabelValues(rule.origin.Kind, rule.origin.Namespace).Inc()
+		if owned {
+			self.stats.updated++
+		} else {
+			self.stats.added++
+		}
+	}
+
+	for filename, entry := range self.manifest.Rules {
+		if wanted[filename] || !owns(entry.ruleOrigin) {
+			continue
+		}
+		log.Printf("Removing rule file %s.\n", filename)
+		if err := self.writer.Remove(filename); err != nil {
+			log.Printf("%s\n", err)
+			writeErr = err
+			continue
+		}
+		delete(self.manifest.Rules, filename)
+		self.freed[entry.RuleName] = true
+		self.stats.removed++
+		rulesDeleted.WithLabelValues(entry.Kind, entry.Namespace).Inc()
+	}
+
+	return writeErr
+}
+
+func (self *ruleSync) reject(rule elastalertRule, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	log.Printf("Rejecting rule %q from %s: %s.\n", rule.name, rule.origin, reason)
+	self.stats.rejected++
+	self.fail(rule.origin, fmt.Errorf("Rule %q: %s", rule.name, reason))
+	rulesRejected.WithLabelValues(rule.origin.Kind, rule.origin.Namespace).Inc()
+}
+
+// result returns what the sync did with the rules of an origin so far.
+func (self *ruleSync) result(origin ruleOrigin) *ruleResult {
+	result, ok := self.results[origin]
+	if !ok {
+		result = &ruleResult{}
+		self.results[origin] = result
+	}
+	return result
+}
+
+// fail records an error against an origin, e.g. a rule that could not be parsed.
+func (self *ruleSync) fail(origin ruleOrigin, err error) {
+	result := self.result(origin)
+	result.errors = append(result.errors, err.Error())
+}
+
+func (self *ruleSync) loaded(rule elastalertRule, filename string) {
+	result := self.result(rule.origin)
+	result.files = append(result.files, filename)
+}
+
+// needsResync reports whether a rule was rejected as a duplicate of a rule that was
+// removed later in the same sync, and would now be accepted.
+func (self *ruleSync) needsResync() bool {
+	for name := range self.duplicates {
+		if self.freed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// commit saves the manifest and makes the changes visible to elastalert.
+func (self *ruleSync) commit() error {
+	log.Printf("Rule sync complete: %s.\n", self.stats)
+	if !self.stats.changed() && !self.originsChanged {
+		self.writer.Abort()
+		return nil
+	}
+
+	if err := self.manifest.save(self.writer); err != nil {
+		self.writer.Abort()
+		return err
+	}
+	return self.writer.Commit()
+}
+
+// Longest rule file name written, well below the 255 bytes most filesystems allow.
+const maxRuleFileName = 200
+
+/*
+ Builds a file name that is unique per source kind, namespace, object and rule name,
+ e.g. default_frontend_error-rate.service.yaml.
+*/
+func ruleFileName(rule elastalertRule) string {
+	var parts []string
+	for _, part := range []string{rule.origin.Namespace, rule.origin.Name, rule.name} {
+		if part != "" {
+			parts = append(parts, sanitizeFileNamePart(part))
+		}
+	}
+	base := strings.Join(parts, "_")
+	suffix := ruleFileSuffixes[rule.origin.Kind]
+
+	if len(base)+len(suffix) > maxRuleFileName {
+		hash := ruleHash(strings.Join([]string{rule.origin.Kind, rule.origin.Namespace, rule.origin.Name, rule.name}, "/"))
+		base = base[:maxRuleFileName-len(suffix)-17] + "-" + hash[:16]
+	}
+	return base + suffix
+}
+
+// validateRuleFileName makes sure a rule file lands directly in the rules directory,
+// is not hidden and is loaded by elastalert.
+func validateRuleFileName(filename string) error {
+	if err := validateFileName(filename); err != nil {
+		return err
+	}
+	if strings.HasPrefix(filename, ".") {
+		return fmt.Errorf("File name %q is hidden", filename)
+	}
+	if !strings.HasSuffix(filename, ".yaml") {
+		return fmt.Errorf("File name %q does not end in .yaml", filename)
+	}
+	return nil
+}
+
+// sanitizeFileNamePart replaces everything but letters, digits, '-' and '.' with '-'.
+// '_' is replaced too, since it separates the parts of a rule file name.
+func sanitizeFileNamePart(part string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '-'
+	}, part)
+}
+
+// ownsObject matches the origins of a single object.
+func ownsObject(kind, namespace, name string) func(ruleOrigin) bool {
+	return func(origin ruleOrigin) bool {
+		return origin.Kind == kind && origin.Namespace == namespace && origin.Name == name
+	}
+}
+
+// ownsKind matches every origin of the given source kind.
+func ownsKind(kind string) func(ruleOrigin) bool {
+	return func(origin ruleOrigin) bool {
+		return origin.Kind == kind
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testRule(kind, namespace, object, name string) elastalertRule {
+	return elastalertRule{
+		rule:   "name: " + name + "\n",
+		name:   name,
+		origin: ruleOrigin{Kind: kind, Namespace: namespace, Name: object},
+	}
+}
+
+func TestRuleFileName(t *testing.T) {
+	tests := []struct {
+		rule     elastalertRule
+		expected string
+	}{
+		{testRule(sourceService, "default", "frontend", "error-rate"), "default_frontend_error-rate.service.yaml"},
+		{testRule(sourceConfigMapMount, "", "rules.yaml", "error rate"), "rules.yaml_error-rate.configmap.yaml"},
+		{testRule(sourceService, "default", "frontend", "../../etc/cron.d/x"), "default_frontend_..-..-etc-cron.d-x.service.yaml"},
+		{testRule(sourceService, "..", "..", ".."), ".._.._...service.yaml"},
+		{testRule(sourceService, "default", "frontend", `..\x`), "default_frontend_..-x.service.yaml"},
+		{testRule(sourceService, "default", "frontend", "a\nb\x00c\x7fd"), "default_frontend_a-b-c-d.service.yaml"},
+		{testRule(sourceService, "default", "frontend", "a_b"), "default_frontend_a-b.service.yaml"},
+		{testRule(sourceConfigMapMount, "", "", ".hidden"), ".hidden.configmap.yaml"},
+	}
+
+	for _, test := range tests {
+		filename := ruleFileName(test.rule)
+		if filename != test.expected {
+			t.Errorf("ruleFileName(%q) = %q, expected %q", test.rule.name, filename, test.expected)
+		}
+		if _, err := safeJoin("/rules", filename); err != nil {
+			t.Errorf("ruleFileName(%q) = %q, which is not a plain file name: %s", test.rule.name, filename, err)
+		}
+	}
+}
+
+func TestRuleFileNameLength(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	a := ruleFileName(testRule(sourceService, "default", "frontend", long))
+	b := ruleFileName(testRule(sourceService, "default", "frontend", long+"y"))
+
+	for _, filename := range []string{a, b} {
+		if len(filename) > maxRuleFileName {
+			t.Errorf("Rule file name is %d bytes long, expected at most %d", len(filename), maxRuleFileName)
+		}
+		if err := validateRuleFileName(filename); err != nil {
+			t.Errorf("Invalid rule file name %q: %s", filename, err)
+		}
+	}
+	if a == b {
+		t.Errorf("Shortened rule file names collide: %q", a)
+	}
+}
+
+func TestValidateRuleFileName(t *testing.T) {
+	tests := []struct {
+		filename string
+		ok       bool
+	}{
+		{"default_frontend_error-rate.service.yaml", true},
+		{".hidden.configmap.yaml", false},
+		{manifestFileName, false},
+		{"rule.yml", false},
+		{"../rule.yaml", false},
+		{"rule\n.yaml", false},
+	}
+
+	for _, test := range tests {
+		err := validateRuleFileName(test.filename)
+		if test.ok && err != nil {
+			t.Errorf("validateRuleFileName(%q) failed: %s", test.filename, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("validateRuleFileName(%q) succeeded, expected an error", test.filename)
+		}
+	}
+}
+
+/*
+ Creates a rules directory next to a file outside of it, which no sync may touch.
+ Returns the temp directory holding both, the rules directory and the outside file.
+*/
+func rulesDirectory(t *testing.T) (string, string, string) {
+	dir := tempDir(t)
+	rules := filepath.Join(dir, "rules")
+	if err := os.Mkdir(rules, 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "outside.yaml")
+	if err := ioutil.WriteFile(outside, []byte("outside\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, rules, outside
+}
+
+func assertUntouched(t *testing.T, outside string) {
+	data, err := ioutil.ReadFile(outside)
+	if err != nil {
+		t.Errorf("File outside of the rules directory is gone: %s", err)
+		return
+	}
+	if string(data) != "outside\n" {
+		t.Errorf("File outside of the rules directory was overwritten with %q", data)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		desc     string
+		rule     elastalertRule
+		filename string
+		rejected int
+	}{
+		{"plain rule", testRule(sourceService, "default", "frontend", "error-rate"), "default_frontend_error-rate.service.yaml", 0},
+		{"traversal in rule name", testRule(sourceService, "default", "frontend", "../outside"), "default_frontend_..-outside.service.yaml", 0},
+		{"traversal in object name", testRule(sourceService, "default", "../outside", "x"), "default_..-outside_x.service.yaml", 0},
+		{"traversal in key name", testRule(sourceConfigMapMount, "", "../outside.yaml", "x"), "", 1},
+		{"control characters", testRule(sourceService, "default", "frontend", "a\nb"), "default_frontend_a-b.service.yaml", 0},
+		{"hidden file name", testRule(sourceConfigMapMount, "", "", ".outside"), "", 1},
+	}
+
+	for _, test := range tests {
+		dir, rules, outside := rulesDirectory(t)
+
+		s, err := beginRuleSync(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.reconcile(ownsKind(test.rule.origin.Kind), []elastalertRule{test.rule}); err != nil {
+			t.Errorf("%s: reconcile failed: %s", test.desc, err)
+		}
+		if err := s.commit(); err != nil {
+			t.Errorf("%s: commit failed: %s", test.desc, err)
+		}
+
+		if s.stats.rejected != test.rejected {
+			t.Errorf("%s: %d rules rejected, expected %d", test.desc, s.stats.rejected, test.rejected)
+		}
+		if test.filename != "" {
+			if _, err := os.Stat(filepath.Join(rules, test.filename)); err != nil {
+				t.Errorf("%s: rule file not written: %s", test.desc, err)
+			}
+		}
+		assertUntouched(t, outside)
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		if len(files) != 2 {
+			t.Errorf("%s: found %v next to the rules directory", test.desc, files)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReconcileManifestTraversal(t *testing.T) {
+	dir, rules, outside := rulesDirectory(t)
+	defer os.RemoveAll(dir)
+
+	manifest := RuleManifest{Rules: map[string]manifestEntry{
+		"../outside.yaml": {ruleOrigin: ruleOrigin{Kind: sourceService, Namespace: "default", Name: "frontend"}, RuleName: "x"},
+	}}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rules, manifestFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := beginRuleSync(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the manifest entry is stale, since the origin has no rules any more
+	if err := s.reconcile(ownsKind(sourceService), nil); err == nil {
+		t.Errorf("Removing ../outside.yaml succeeded")
+	}
+	assertUntouched(t, outside)
+}
+
+func TestReconcileSymlink(t *testing.T) {
+	rule := testRule(sourceService, "default", "frontend", "error-rate")
+	filename := ruleFileName(rule)
+
+	for _, owned := range []bool{false, true} {
+		dir, rules, outside := rulesDirectory(t)
+
+		if owned {
+			s, err := beginRuleSync(rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.reconcile(ownsKind(sourceService), []elastalertRule{rule}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.commit(); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(filepath.Join(rules, filename))
+		} else {
+			// without a manifest the file would be adopted as a legacy rule
+			if err := ioutil.WriteFile(filepath.Join(rules, manifestFileName), []byte(`{"rules":{}}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink(outside, filepath.Join(rules, filename)); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := beginRuleSync(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed := rule
+		changed.rule += "index: logs-*\n"
+		if err := s.reconcile(ownsKind(sourceService), []elastalertRule{changed}); err != nil {
+			t.Errorf("Owned %v: reconcile failed: %s", owned, err)
+		}
+		if err := s.commit(); err != nil {
+			t.Errorf("Owned %v: commit failed: %s", owned, err)
+		}
+		assertUntouched(t, outside)
+
+		fi, err := os.Lstat(filepath.Join(rules, filename))
+		switch {
+		case err != nil:
+			t.Errorf("Owned %v: %s", owned, err)
+		case !owned && (s.stats.rejected != 1 || fi.Mode()&os.ModeSymlink == 0):
+			// someone else's file, left alone
+			t.Errorf("Owned %v: the symlink was replaced", owned)
+		case owned && !fi.Mode().IsRegular():
+			// the loader's own file, replaced rather than written through
+			t.Errorf("Owned %v: the symlink was written through", owned)
+		}
+		os.RemoveAll(dir)
+	}
+}
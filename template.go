@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ What a rule template can refer to, e.g. {{ .Namespace }} or {{ .Labels.app }}.
+ Selector holds the label selector of objects that have one, such as services.
+*/
+type templateContext struct {
+	Kind        string
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	ClusterName string
+	Selector    map[string]string
+	// the parameters of a library template
+	Params map[string]interface{}
+}
+
+var templateFuncs = template.FuncMap{
+	// quote makes a value safe to use as a YAML string.
+	"quote": strconv.Quote,
+}
+
+/*
+ Renders a rule annotation or rule file as a Go template when -templates is set,
+ and returns it unchanged otherwise. A reference to a missing map key is an error,
+ so a typo in a label name does not silently produce an empty query.
+*/
+func renderRuleTemplate(name, value string, context templateContext) (string, error) {
+	if !*renderTemplates {
+		return value, nil
+	}
+	tmpl, err := parseRuleTemplate(name, value)
+	if err != nil {
+		return "", err
+	}
+	return executeRuleTemplate(tmpl, context)
+}
+
+func parseRuleTemplate(name, value string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(value)
+}
+
+func executeRuleTemplate(tmpl *template.Template, context templateContext) (string, error) {
+	context.ClusterName = *clusterName
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, context); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+/*
+ A parameterized rule from the template library. Rule is a Go template that may
+ render one or more rules and gets the parameters, with their defaults filled in,
+ as .Params.
+*/
+type ruleTemplate struct {
+	Parameters map[string]templateParameter `yaml:"parameters"`
+	Rule       string                       `yaml:"rule"`
+
+	name string
+	tmpl *template.Template
+}
+
+type templateParameter struct {
+	Required    bool        `yaml:"required"`
+	Default     interface{} `yaml:"default"`
+	Description string      `yaml:"description"`
+}
+
+// params checks the parameters given to a template and fills in the defaults.
+func (self *ruleTemplate) params(given map[interface{}]interface{}) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	for key, value := range given {
+		name := fmt.Sprint(key)
+		if _, ok := self.Parameters[name]; !ok {
+			return nil, fmt.Errorf("Template %s has no parameter %q", self.name, name)
+		}
+		params[name] = value
+	}
+
+	var missing []string
+	for name, param := range self.Parameters {
+		if _, ok := params[name]; ok {
+			continue
+		}
+		if param.Required {
+			missing = append(missing, name)
+		} else {
+			params[name] = param.Default
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("Template %s requires parameters %s", self.name, strings.Join(missing, ", "))
+	}
+	return params, nil
+}
+
+/*
+ Holds the rule templates found in a directory, typically a mounted ConfigMap. A
+ template is named after its file, without the .yaml or .yml extension.
+*/
+type TemplateLibrary struct {
+	directory string
+	mutex     *sync.Mutex
+	templates map[string]*ruleTemplate
+}
+
+// NewTemplateLibrary loads the templates of a directory, which must exist.
+func NewTemplateLibrary(directory string) (*TemplateLibrary, error) {
+	fi, err := os.Stat(directory)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rule template library. Error: %s", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Rule template library %s is not a directory", directory)
+	}
+
+	library := &TemplateLibrary{directory: directory, mutex: &sync.Mutex{}}
+	library.Reload()
+	return library, nil
+}
+
+// Reload reads the library again. Templates that fail to load are logged and left out.
+func (self *TemplateLibrary) Reload() {
+	templates := map[string]*ruleTemplate{}
+	for _, file := range GatherFilesFromConfigmap(self.directory) {
+		rel, err := filepath.Rel(self.directory, file)
+		if err != nil || strings.HasPrefix(filepath.Base(rel), ".") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(rel, ".yaml"), ".yml")
+
+		tmpl, err := loadRuleTemplate(name, file)
+		if err != nil {
+			log.Printf("Unable to load rule template %s. Error: %s\n", file, err)
+			continue
+		}
+		templates[name] = tmpl
+	}
+	log.Printf("Loaded %d rule templates from %s.\n", len(templates), self.directory)
+
+	self.mutex.Lock()
+	self.templates = templates
+	self.mutex.Unlock()
+}
+
+func loadRuleTemplate(name, file string) (*ruleTemplate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &ruleTemplate{name: name}
+	if err := yaml.Unmarshal(data, tmpl); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(tmpl.Rule) == "" {
+		return nil, fmt.Errorf("Template has no rule")
+	}
+	if tmpl.tmpl, err = parseRuleTemplate(name, tmpl.Rule); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func (self *TemplateLibrary) get(name string) (*ruleTemplate, bool) {
+	if self == nil {
+		return nil, false
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	tmpl, ok := self.templates[name]
+	return tmpl, ok
+}
+
+/*
+ Expands a rule that references a library template by name, with a map of
+ parameters, into the rules the template renders. Any other option of the reference
+ overrides the option of every rendered rule. Rules without a template are returned
+ as they are.
+*/
+func (self *TemplateLibrary) expand(rule map[string]interface{}, context templateContext) ([]map[string]interface{}, error) {
+	ref, ok := rule["template"]
+	if !ok {
+		return []map[string]interface{}{rule}, nil
+	}
+	name, ok := ref.(string)
+	if !ok {
+		return nil, fmt.Errorf("Template reference %v is not a template name", ref)
+	}
+	tmpl, ok := self.get(name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown rule template %q", name)
+	}
+
+	given, ok := rule["parameters"].(map[interface{}]interface{})
+	if !ok && rule["parameters"] != nil {
+		return nil, fmt.Errorf("Parameters of template %s must be a map", name)
+	}
+	params, err := tmpl.params(given)
+	if err != nil {
+		return nil, err
+	}
+	context.Params = params
+
+	rendered, err := executeRuleTemplate(tmpl.tmpl, context)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to render template %s. Error: %s", name, err)
+	}
+	rules, err := parseRules(rendered)
+	if err != nil {
+		return nil, fmt.Errorf("Template %s did not render valid YAML. Error: %s", name, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("Template %s rendered no rules", name)
+	}
+
+	overrides := map[string]interface{}{}
+	for key, value := range rule {
+		if key != "template" && key != "parameters" {
+			overrides[key] = value
+		}
+	}
+	for _, expanded := range rules {
+		overlayOptions(expanded, overrides)
+	}
+	return rules, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTemplateLibraryMissingDirectory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := NewTemplateLibrary(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Loaded a library from a missing directory")
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTemplateLibrary(file); err == nil {
+		t.Errorf("Loaded a library from a file")
+	}
+}
+
+func TestTemplateLibraryDanglingSymlink(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a ConfigMap key whose target went away during an update
+	if err := os.Symlink(filepath.Join(dir, "..data", "gone.yaml"), filepath.Join(dir, "gone.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "error-rate.yaml"), []byte("rule: |\n  name: {{ .Name }}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	library, err := NewTemplateLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := library.get("error-rate"); !ok {
+		t.Errorf("Template error-rate not loaded")
+	}
+	if _, ok := library.get("gone"); ok {
+		t.Errorf("Template gone loaded")
+	}
+}
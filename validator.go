@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type optionKind int
+
+const (
+	optString optionKind = iota
+	optInt
+	optNumber
+	optBool
+	optList
+	optStringOrList
+	optMap
+	// A dict of time units, e.g. {minutes: 5}, turned into a timedelta by elastalert.
+	optTimeframe
+)
+
+func (self optionKind) String() string {
+	switch self {
+	case optString:
+		return "a string"
+	case optInt:
+		return "an integer"
+	case optNumber:
+		return "a number"
+	case optBool:
+		return "true or false"
+	case optList:
+		return "a list"
+	case optStringOrList:
+		return "a string or a list of strings"
+	case optMap:
+		return "a map"
+	case optTimeframe:
+		return "a time period such as {minutes: 5}"
+	}
+	return "unknown"
+}
+
+// Types of the options of every rule type.
+var commonOptionKinds = map[string]optionKind{
+	"name":                optString,
+	"type":                optString,
+	"index":               optString,
+	"description":         optString,
+	"filter":              optList,
+	"query_key":           optStringOrList,
+	"realert":             optTimeframe,
+	"exponential_realert": optTimeframe,
+	"buffer_time":         optTimeframe,
+	"query_delay":         optTimeframe,
+	"timestamp_field":     optString,
+	"timestamp_type":      optString,
+	"use_local_time":      optBool,
+	"use_strftime_index":  optBool,
+	"max_query_size":      optInt,
+	"top_count_keys":      optList,
+	"top_count_number":    optInt,
+	"include":             optList,
+	"priority":            optInt,
+	"is_enabled":          optBool,
+	"alert_text":          optString,
+	"alert_subject":       optString,
+	"alert_text_args":     optList,
+	"alert_subject_args":  optList,
+	"match_enhancements":  optList,
+}
+
+// Types of the options of specific rule types.
+var typeOptionKinds = map[string]optionKind{
+	"compare_key":               optStringOrList,
+	"blacklist":                 optList,
+	"whitelist":                 optList,
+	"ignore_null":               optBool,
+	"timeframe":                 optTimeframe,
+	"num_events":                optInt,
+	"attach_related":            optBool,
+	"use_count_query":           optBool,
+	"use_terms_query":           optBool,
+	"terms_size":                optInt,
+	"doc_type":                  optString,
+	"spike_height":              optNumber,
+	"spike_type":                optString,
+	"field_value":               optString,
+	"threshold_ref":             optInt,
+	"threshold_cur":             optInt,
+	"alert_on_new_data":         optBool,
+	"threshold":                 optInt,
+	"forget_keys":               optBool,
+	"fields":                    optList,
+	"terms_window_size":         optTimeframe,
+	"window_step_size":          optTimeframe,
+	"alert_on_missing_field":    optBool,
+	"use_keyword_postfix":       optBool,
+	"cardinality_field":         optString,
+	"max_cardinality":           optInt,
+	"min_cardinality":           optInt,
+	"metric_agg_key":            optString,
+	"metric_agg_type":           optString,
+	"max_threshold":             optNumber,
+	"min_threshold":             optNumber,
+	"bucket_interval":           optTimeframe,
+	"sync_bucket_interval":      optBool,
+	"allow_buffer_time_overlap": optBool,
+	"use_run_every_query_size":  optBool,
+	"match_bucket_filter":       optList,
+	"min_percentage":            optNumber,
+	"max_percentage":            optNumber,
+	"percentage_format_string":  optString,
+}
+
+// Values accepted by options with a fixed set of values.
+var ruleOptionValues = map[string][]string{
+	"timestamp_type":  {"iso", "unix", "unix_ms", "custom"},
+	"spike_type":      {"up", "down", "both"},
+	"metric_agg_type": {"min", "max", "avg", "sum", "cardinality", "value_count"},
+}
+
+// Options every rule needs, whatever its type.
+var commonRuleOptions = []string{"name", "type", "index", "alert"}
+
+/*
+ The options of a built-in elastalert rule type. At least one option of every
+ oneOf group must be set.
+*/
+type ruleTypeSchema struct {
+	required []string
+	oneOf    [][]string
+	optional []string
+}
+
+// options lists every option the rule type knows about.
+func (self ruleTypeSchema) options() []string {
+	options := append([]string{}, self.required...)
+	options = append(options, self.optional...)
+	for _, group := range self.oneOf {
+		options = append(options, group...)
+	}
+	return options
+}
+
+var countQueryOptions = []string{"use_count_query", "use_terms_query", "terms_size", "doc_type"}
+
+var ruleTypeSchemas = map[string]ruleTypeSchema{
+	"any": {},
+	"blacklist": {
+		required: []string{"compare_key", "blacklist"},
+	},
+	"whitelist": {
+		required: []string{"compare_key", "whitelist", "ignore_null"},
+	},
+	"change": {
+		required: []string{"compare_key", "ignore_null", "query_key"},
+		optional: []string{"timeframe"},
+	},
+	"frequency": {
+		required: []string{"num_events", "timeframe"},
+		optional: append([]string{"attach_related"}, countQueryOptions...),
+	},
+	"spike": {
+		required: []string{"spike_height", "spike_type", "timeframe"},
+		optional: append([]string{"field_value", "threshold_ref", "threshold_cur", "alert_on_new_data"}, countQueryOptions...),
+	},
+	"flatline": {
+		required: []string{"threshold", "timeframe"},
+		optional: append([]string{"forget_keys"}, countQueryOptions...),
+	},
+	"new_term": {
+		oneOf:    [][]string{{"fields", "query_key"}},
+		optional: []string{"terms_window_size", "window_step_size", "alert_on_missing_field", "use_terms_query", "doc_type", "use_keyword_postfix"},
+	},
+	"cardinality": {
+		required: []string{"cardinality_field", "timeframe"},
+		oneOf:    [][]string{{"max_cardinality", "min_cardinality"}},
+	},
+	"metric_aggregation": {
+		required: []string{"metric_agg_key", "metric_agg_type"},
+		oneOf:    [][]string{{"max_threshold", "min_threshold"}},
+		optional: []string{"doc_type", "bucket_interval", "sync_bucket_interval", "allow_buffer_time_overlap", "use_run_every_query_size"},
+	},
+	"percentage_match": {
+		required: []string{"match_bucket_filter"},
+		oneOf:    [][]string{{"min_percentage", "max_percentage"}},
+		optional: []string{"doc_type", "bucket_interval", "sync_bucket_interval", "percentage_format_string"},
+	},
+}
+
+// Units elastalert accepts in a timeframe.
+var timeframeUnits = map[string]bool{
+	"weeks": true, "days": true, "hours": true, "minutes": true,
+	"seconds": true, "milliseconds": true, "microseconds": true,
+}
+
+/*
+ Collects every problem found with a rule, one entry per field.
+*/
+type ruleErrors []string
+
+func (self *ruleErrors) add(field, format string, args ...interface{}) {
+	*self = append(*self, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (self ruleErrors) Error() string {
+	return strings.Join(self, "; ")
+}
+
+/*
+ Checks that elastalert will load a rule: the rule has every option its type
+ requires, and every known option has the right type. Rule types given as a
+ module path (e.g. my_rules.MyRule) are custom and only get the common checks.
+*/
+func validateRule(ruleMap map[string]interface{}) error {
+	var errs ruleErrors
+	for _, option := range commonRuleOptions {
+		if _, ok := ruleMap[option]; !ok {
+			errs.add(option, "is required")
+		}
+	}
+
+	options := map[string]optionKind{}
+	for option, kind := range commonOptionKinds {
+		options[option] = kind
+	}
+
+	ruleType, _ := ruleMap["type"].(string)
+	if schema, ok := ruleTypeSchemas[ruleType]; ok {
+		for _, option := range schema.required {
+			if _, ok := ruleMap[option]; !ok {
+				errs.add(option, "is required by %s rules", ruleType)
+			}
+		}
+		for _, group := range schema.oneOf {
+			if !hasAnyOption(ruleMap, group) {
+				errs.add(strings.Join(group, "|"), "one of these is required by %s rules", ruleType)
+			}
+		}
+		for _, option := range schema.options() {
+			if kind, ok := typeOptionKinds[option]; ok {
+				options[option] = kind
+			}
+		}
+	} else if ruleType != "" && !strings.Contains(ruleType, ".") {
+		errs.add("type", "unknown rule type %q, expected one of %s or a module path", ruleType, strings.Join(ruleTypeNames(), ", "))
+	}
+
+	var present []string
+	for option := range options {
+		if _, ok := ruleMap[option]; ok {
+			present = append(present, option)
+		}
+	}
+	sort.Strings(present)
+	for _, option := range present {
+		value := ruleMap[option]
+		if isSecretRef(value) {
+			continue
+		}
+		if err := checkOption(options[option], value); err != "" {
+			errs.add(option, "%s", err)
+			continue
+		}
+		if allowed, ok := ruleOptionValues[option]; ok && !containsString(allowed, value.(string)) {
+			errs.add(option, "must be one of %s", strings.Join(allowed, ", "))
+		}
+	}
+	if n, ok := ruleMap["num_events"].(int); ok && n < 1 {
+		errs.add("num_events", "must be at least 1")
+	}
+
+	validateAlerts(ruleMap, &errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// isTimeframeOption reports whether an option of any rule type is a time period.
+func isTimeframeOption(option string) bool {
+	return commonOptionKinds[option] == optTimeframe || typeOptionKinds[option] == optTimeframe
+}
+
+// checkOption returns a description of what is wrong with value, or "".
+func checkOption(kind optionKind, value interface{}) string {
+	ok := false
+	switch kind {
+	case optString:
+		_, ok = value.(string)
+	case optInt:
+		ok = isInt(value)
+	case optNumber:
+		_, isFloat := value.(float64)
+		ok = isFloat || isInt(value)
+	case optBool:
+		_, ok = value.(bool)
+	case optList:
+		_, ok = value.([]interface{})
+	case optStringOrList:
+		if _, ok = value.(string); !ok {
+			ok = isStringList(value)
+		}
+	case optMap:
+		_, ok = value.(map[interface{}]interface{})
+	case optTimeframe:
+		return checkTimeframe(value)
+	}
+	if !ok {
+		return "must be " + kind.String()
+	}
+	return ""
+}
+
+func checkTimeframe(value interface{}) string {
+	timeframe, ok := value.(map[interface{}]interface{})
+	if !ok || len(timeframe) == 0 {
+		return "must be " + optTimeframe.String()
+	}
+	for unit, amount := range timeframe {
+		name, _ := unit.(string)
+		if !timeframeUnits[name] {
+			return fmt.Sprintf("unknown time unit %v", unit)
+		}
+		if checkOption(optNumber, amount) != "" {
+			return fmt.Sprintf("%s must be a number", name)
+		}
+	}
+	return ""
+}
+
+func isInt(value interface{}) bool {
+	switch value.(type) {
+	case int, int64, uint64:
+		return true
+	}
+	return false
+}
+
+func isStringList(value interface{}) bool {
+	list, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, item := range list {
+		if _, ok := item.(string); !ok && !isSecretRef(item) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyOption(ruleMap map[string]interface{}, options []string) bool {
+	for _, option := range options {
+		if _, ok := ruleMap[option]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleTypeNames() []string {
+	var names []string
+	for name := range ruleTypeSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A valid rule of every built-in rule type, without the common options.
+var validRuleTypeOptions = map[string]string{
+	"any":                "type: any",
+	"blacklist":          "type: blacklist\ncompare_key: user\nblacklist: [root]",
+	"whitelist":          "type: whitelist\ncompare_key: user\nwhitelist: [app]\nignore_null: true",
+	"change":             "type: change\ncompare_key: status\nignore_null: true\nquery_key: host",
+	"frequency":          "type: frequency\nnum_events: 5\ntimeframe: {minutes: 5}",
+	"spike":              "type: spike\nspike_height: 2\nspike_type: up\ntimeframe: {hours: 1}",
+	"flatline":           "type: flatline\nthreshold: 1\ntimeframe: {minutes: 10}",
+	"new_term":           "type: new_term\nfields: [user]",
+	"cardinality":        "type: cardinality\ncardinality_field: user\ntimeframe: {hours: 1}\nmax_cardinality: 10",
+	"metric_aggregation": "type: metric_aggregation\nmetric_agg_key: latency\nmetric_agg_type: avg\nmax_threshold: 100",
+	"percentage_match":   "type: percentage_match\nmatch_bucket_filter: [{term: {status: 500}}]\nmin_percentage: 5",
+}
+
+const commonTestOptions = "name: test\nindex: logs-*\nalert: debug\n"
+
+func parseTestRule(t *testing.T, data string) map[string]interface{} {
+	var rule map[string]interface{}
+	if err := yaml.Unmarshal([]byte(data), &rule); err != nil {
+		t.Fatalf("Invalid test rule %q: %s", data, err)
+	}
+	return rule
+}
+
+// ruleErrorList returns the field errors of a validation error, sorted.
+func ruleErrorList(err error) []string {
+	if err == nil {
+		return nil
+	}
+	errs := append([]string{}, err.(ruleErrors)...)
+	sort.Strings(errs)
+	return errs
+}
+
+func expectRuleErrors(t *testing.T, desc string, err error, expected []string) {
+	sort.Strings(expected)
+	if got := ruleErrorList(err); !reflect.DeepEqual(got, expected) {
+		t.Errorf("%s: got errors %q, expected %q", desc, got, expected)
+	}
+}
+
+func TestValidateRuleTypes(t *testing.T) {
+	if len(validRuleTypeOptions) != len(ruleTypeSchemas) {
+		t.Errorf("Test rules cover %d rule types, expected %d", len(validRuleTypeOptions), len(ruleTypeSchemas))
+	}
+
+	for ruleType, options := range validRuleTypeOptions {
+		expectRuleErrors(t, ruleType, validateRule(parseTestRule(t, commonTestOptions+options)), nil)
+
+		schema := ruleTypeSchemas[ruleType]
+		for _, option := range schema.required {
+			rule := parseTestRule(t, commonTestOptions+options)
+			delete(rule, option)
+			expectRuleErrors(t, ruleType+" without "+option, validateRule(rule), []string{
+				option + ": is required by " + ruleType + " rules",
+			})
+		}
+		for _, group := range schema.oneOf {
+			rule := parseTestRule(t, commonTestOptions+options)
+			for _, option := range group {
+				delete(rule, option)
+			}
+			expectRuleErrors(t, ruleType+" without "+strings.Join(group, "|"), validateRule(rule), []string{
+				strings.Join(group, "|") + ": one of these is required by " + ruleType + " rules",
+			})
+		}
+	}
+}
+
+func TestValidateRuleOptions(t *testing.T) {
+	tests := []struct {
+		desc     string
+		rule     string
+		expected []string
+	}{
+		{"missing common options", "type: any", []string{"name: is required", "index: is required", "alert: is required"}},
+		{"missing type", "name: test\nindex: logs-*\nalert: debug", []string{"type: is required"}},
+		{"unknown type", commonTestOptions + "type: bogus", []string{
+			`type: unknown rule type "bogus", expected one of ` + strings.Join(ruleTypeNames(), ", ") + " or a module path",
+		}},
+		{"module path type", commonTestOptions + "type: my_rules.MyRule\nnum_events: many", nil},
+		{"module path type with wrong common option", commonTestOptions + "type: my_rules.MyRule\nrealert: 5", []string{
+			"realert: must be a time period such as {minutes: 5}",
+		}},
+		{"integer", commonTestOptions + "type: frequency\nnum_events: five\ntimeframe: {minutes: 5}", []string{"num_events: must be an integer"}},
+		{"at least one event", commonTestOptions + "type: frequency\nnum_events: 0\ntimeframe: {minutes: 5}", []string{"num_events: must be at least 1"}},
+		{"number", commonTestOptions + "type: metric_aggregation\nmetric_agg_key: latency\nmetric_agg_type: avg\nmax_threshold: high", []string{"max_threshold: must be a number"}},
+		{"float number", commonTestOptions + "type: spike\nspike_height: 1.5\nspike_type: up\ntimeframe: {hours: 1}", nil},
+		{"bool", commonTestOptions + "type: whitelist\ncompare_key: user\nwhitelist: [app]\nignore_null: yes please", []string{"ignore_null: must be true or false"}},
+		{"list", commonTestOptions + "type: any\nfilter: {term: {status: 500}}", []string{"filter: must be a list"}},
+		{"string", commonTestOptions + "type: any\ndescription: [a]", []string{"description: must be a string"}},
+		{"string or list", commonTestOptions + "type: change\ncompare_key: status\nignore_null: true\nquery_key: [host, 1]", []string{"query_key: must be a string or a list of strings"}},
+		{"timeframe", commonTestOptions + "type: frequency\nnum_events: 5\ntimeframe: 5", []string{"timeframe: must be a time period such as {minutes: 5}"}},
+		{"empty timeframe", commonTestOptions + "type: frequency\nnum_events: 5\ntimeframe: {}", []string{"timeframe: must be a time period such as {minutes: 5}"}},
+		{"timeframe unit", commonTestOptions + "type: frequency\nnum_events: 5\ntimeframe: {fortnights: 1}", []string{"timeframe: unknown time unit fortnights"}},
+		{"timeframe amount", commonTestOptions + "type: frequency\nnum_events: 5\ntimeframe: {minutes: five}", []string{"timeframe: minutes must be a number"}},
+		{"fractional timeframe", commonTestOptions + "type: any\nrealert: {minutes: 1.5}", nil},
+		{"fixed values", commonTestOptions + "type: spike\nspike_height: 2\nspike_type: sideways\ntimeframe: {hours: 1}", []string{"spike_type: must be one of up, down, both"}},
+		{"option of another type", commonTestOptions + "type: any\nnum_events: many", nil},
+		{"several errors", commonTestOptions + "type: frequency\nnum_events: five\ntimeframe: 5\nrealert: 1", []string{
+			"num_events: must be an integer",
+			"realert: must be a time period such as {minutes: 5}",
+			"timeframe: must be a time period such as {minutes: 5}",
+		}},
+		{"secret reference", commonTestOptions + "type: frequency\nnum_events: 5\ntimeframe: {minutes: 5}\nalert_text: {secretKeyRef: {name: s, key: k}}", nil},
+		{"secret reference in a list", commonTestOptions + "type: change\ncompare_key: status\nignore_null: true\nquery_key: [host, {secretKeyRef: {name: s, key: k}}]", nil},
+	}
+
+	for _, test := range tests {
+		expectRuleErrors(t, test.desc, validateRule(parseTestRule(t, test.rule)), test.expected)
+	}
+}
+
+func TestRuleErrorsError(t *testing.T) {
+	err := validateRule(parseTestRule(t, "type: any\nname: test"))
+	if err == nil || err.Error() != "index: is required; alert: is required" {
+		t.Errorf("Got %v", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
  happened during the specified duration.
 */
 type FileWatcher struct {
+	path     string
 	fsNotify *fsnotify.Watcher
 	interval time.Duration
 	done     chan struct{}
@@ -31,6 +32,7 @@ func WatchFile(path string, interval time.Duration, action func()) (*FileWatcher
 	fsWatcher.Add(path)
 
 	watcher := &FileWatcher{
+		path,
 		fsWatcher,
 		interval,
 		make(chan struct{}, 1),
@@ -50,6 +52,8 @@ func (self *FileWatcher) run() {
 	for {
 		select {
 		case event := <-self.fsNotify.Events:
+			fileWatcherEvents.WithLabelValues(self.path, eventOp(event.Op)).Inc()
+
 			// When a ConfigMap update occurs kubernetes AtomicWriter() creates a new directory;
 			// writing the updated ConfigMap contents to the new directory. Once the write is
 			// complete it removes the original file symlink and replaces it with a new symlink
@@ -97,3 +101,20 @@ func (self *FileWatcher) Close() {
 	self.done <- struct{}{}
 	self.fsNotify.Close()
 }
+
+// eventOp names the operation of a file system event.
+func eventOp(op fsnotify.Op) string {
+	switch {
+	case op&fsnotify.Create != 0:
+		return "create"
+	case op&fsnotify.Write != 0:
+		return "write"
+	case op&fsnotify.Remove != 0:
+		return "remove"
+	case op&fsnotify.Rename != 0:
+		return "rename"
+	case op&fsnotify.Chmod != 0:
+		return "chmod"
+	}
+	return "unknown"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// Set by the deployment controller on the replica sets it manages, which also get a
+// copy of the annotations of their deployment.
+const deploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+
+// Rule source kinds of the annotated resources, by the resource name -annotatedResources takes.
+var annotatedKinds = map[string]func(kubeClient *kclient.Client) *objectKind{
+	"services":    serviceKind,
+	"deployments": deploymentKind,
+	"replicasets": replicaSetKind,
+	"daemonsets":  daemonSetKind,
+	"jobs":        jobKind,
+	"ingresses":   ingressKind,
+}
+
+// parseAnnotatedKinds returns the rule source kinds of a comma separated list of resources.
+func parseAnnotatedKinds(kubeClient *kclient.Client, resources string) ([]*objectKind, error) {
+	var kinds []*objectKind
+	for _, resource := range strings.Split(resources, ",") {
+		resource = strings.TrimSpace(resource)
+		if resource == "" {
+			continue
+		}
+		newKind, ok := annotatedKinds[resource]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported resource %q", resource)
+		}
+		kinds = append(kinds, newKind(kubeClient))
+	}
+	return kinds, nil
+}
+
+func deploymentKind(kubeClient *kclient.Client) *objectKind {
+	kind := annotatedKind(sourceDeployment, "Deployment", "extensions/v1beta1", "deployments", kubeClient.ExtensionsClient.RESTClient, func() runtime.Object { return &extensions.Deployment{} })
+	kind.templateSelector = func(obj runtime.Object) map[string]string {
+		return matchLabels(obj.(*extensions.Deployment).Spec.Selector)
+	}
+	return kind
+}
+
+func replicaSetKind(kubeClient *kclient.Client) *objectKind {
+	kind := annotatedKind(sourceReplicaSet, "ReplicaSet", "extensions/v1beta1", "replicasets", kubeClient.ExtensionsClient.RESTClient, func() runtime.Object { return &extensions.ReplicaSet{} })
+	kind.templateSelector = func(obj runtime.Object) map[string]string {
+		return matchLabels(obj.(*extensions.ReplicaSet).Spec.Selector)
+	}
+	kind.skip = func(obj runtime.Object) bool {
+		// the rules are loaded from the deployment
+		_, ok := objectMeta(obj).GetAnnotations()[deploymentRevisionAnnotation]
+		return ok
+	}
+	return kind
+}
+
+func daemonSetKind(kubeClient *kclient.Client) *objectKind {
+	kind := annotatedKind(sourceDaemonSet, "DaemonSet", "extensions/v1beta1", "daemonsets", kubeClient.ExtensionsClient.RESTClient, func() runtime.Object { return &extensions.DaemonSet{} })
+	kind.templateSelector = func(obj runtime.Object) map[string]string {
+		return matchLabels(obj.(*extensions.DaemonSet).Spec.Selector)
+	}
+	return kind
+}
+
+// jobKind reads jobs through the batch API group, which holds the same type as extensions.
+func jobKind(kubeClient *kclient.Client) *objectKind {
+	kind := annotatedKind(sourceJob, "Job", "batch/v1", "jobs", kubeClient.BatchClient.RESTClient, func() runtime.Object { return &extensions.Job{} })
+	kind.templateSelector = func(obj runtime.Object) map[string]string {
+		return matchLabels(obj.(*extensions.Job).Spec.Selector)
+	}
+	return kind
+}
+
+func ingressKind(kubeClient *kclient.Client) *objectKind {
+	return annotatedKind(sourceIngress, "Ingress", "extensions/v1beta1", "ingresses", kubeClient.ExtensionsClient.RESTClient, func() runtime.Object { return &extensions.Ingress{} })
+}
+
+// matchLabels returns the equality part of a label selector, which is what templates
+// can match pods on.
+func matchLabels(selector *unversioned.LabelSelector) map[string]string {
+	if selector == nil {
+		return nil
+	}
+	return selector.MatchLabels
+}
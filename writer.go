@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ Applies changes to the rules directory such that elastalert never sees a partially
+ written file. Changes made through a staged writer only become visible, all at once,
+ when Commit is called.
+*/
+type RuleWriter interface {
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Remove(name string) error
+	Commit() error
+	Abort()
+}
+
+func newRuleWriter(rulesLocation string, staged bool) (RuleWriter, error) {
+	if staged {
+		return newStagedRuleWriter(rulesLocation)
+	}
+	return &directRuleWriter{rulesLocation}, nil
+}
+
+/*
+ Writes each file into the rules directory by renaming a fully written temp file
+ over it.
+*/
+type directRuleWriter struct {
+	dir string
+}
+
+func (self *directRuleWriter) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(self.dir, name, data, perm)
+}
+
+func (self *directRuleWriter) Remove(name string) error {
+	path, err := safeJoin(self.dir, name)
+	if err != nil {
+		return err
+	}
+	return removeIfExists(path)
+}
+
+func (self *directRuleWriter) Commit() error {
+	return syncDir(self.dir)
+}
+
+func (self *directRuleWriter) Abort() {
+	// Do Nothing, every change is already in place
+}
+
+/*
+ Stages a whole sync into a new directory next to the rules directory and swaps it in
+ by replacing the rules directory symlink, the same way kubelet's AtomicWriter updates
+ ConfigMap volumes. The rules directory must be a symlink, or not exist yet.
+*/
+type stagedRuleWriter struct {
+	link    string
+	current string
+	staging string
+}
+
+func newStagedRuleWriter(rulesLocation string) (*stagedRuleWriter, error) {
+	writer := &stagedRuleWriter{link: filepath.Clean(rulesLocation)}
+
+	fi, err := os.Lstat(writer.link)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("Unable to stat rules directory %s. Error: %s", writer.link, err)
+	case fi.Mode()&os.ModeSymlink == 0:
+		return nil, fmt.Errorf("Rules directory %s must be a symlink to use staged writes.", writer.link)
+	default:
+		// Only the link itself is resolved, so current is found next to the link even
+		// if a parent directory is a symlink too.
+		target, err := os.Readlink(writer.link)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve rules directory %s. Error: %s", writer.link, err)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(writer.link), target)
+		}
+		writer.current = filepath.Clean(target)
+	}
+
+	writer.staging, err = ioutil.TempDir(filepath.Dir(writer.link), writer.stagingPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create staging directory for %s. Error: %s", writer.link, err)
+	}
+	// elastalert usually runs as a different user in another container
+	if err := os.Chmod(writer.staging, 0755); err != nil {
+		writer.Abort()
+		return nil, fmt.Errorf("Unable to set permissions on %s. Error: %s", writer.staging, err)
+	}
+
+	if writer.current != "" {
+		if err := linkTree(writer.current, writer.staging); err != nil {
+			writer.Abort()
+			return nil, fmt.Errorf("Unable to stage rules directory %s. Error: %s", writer.current, err)
+		}
+	}
+	return writer, nil
+}
+
+func (self *stagedRuleWriter) stagingPrefix() string {
+	return "." + filepath.Base(self.link) + "."
+}
+
+func (self *stagedRuleWriter) WriteFile(name string, data []byte, perm os.FileMode) error {
+	// writeFileAtomic replaces the staged hard link rather than writing through it,
+	// so the live directory is never modified.
+	return writeFileAtomic(self.staging, name, data, perm)
+}
+
+func (self *stagedRuleWriter) Remove(name string) error {
+	path, err := safeJoin(self.staging, name)
+	if err != nil {
+		return err
+	}
+	return removeIfExists(path)
+}
+
+func (self *stagedRuleWriter) Commit() error {
+	if err := syncDir(self.staging); err != nil {
+		self.Abort()
+		return err
+	}
+
+	tmpLink := self.link + ".tmp"
+	if err := removeIfExists(tmpLink); err != nil {
+		self.Abort()
+		return err
+	}
+	if err := os.Symlink(filepath.Base(self.staging), tmpLink); err != nil {
+		self.Abort()
+		return fmt.Errorf("Unable to create symlink %s. Error: %s", tmpLink, err)
+	}
+	if err := os.Rename(tmpLink, self.link); err != nil {
+		os.Remove(tmpLink)
+		self.Abort()
+		return fmt.Errorf("Unable to swap in rules directory %s. Error: %s", self.staging, err)
+	}
+	if err := syncDir(filepath.Dir(self.link)); err != nil {
+		return err
+	}
+
+	// Only clean up directories this writer created.
+	if filepath.Dir(self.current) == filepath.Dir(self.link) && strings.HasPrefix(filepath.Base(self.current), self.stagingPrefix()) {
+		os.RemoveAll(self.current)
+	}
+	return nil
+}
+
+func (self *stagedRuleWriter) Abort() {
+	os.RemoveAll(self.staging)
+}
+
+// writeFileAtomic writes data into a temp file in dir, syncs it and renames it to name.
+func writeFileAtomic(dir, name string, data []byte, perm os.FileMode) error {
+	filename, err := safeJoin(dir, name)
+	if err != nil {
+		return err
+	}
+	// The temp file name does not end in .yaml so elastalert ignores it.
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for %s. Error: %s", filename, err)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Unable to write %s. Error: %s", filename, err)
+	}
+	return nil
+}
+
+// safeJoin joins dir and name, refusing any name that is not a plain file name
+// directly inside dir.
+func safeJoin(dir, name string) (string, error) {
+	if err := validateFileName(name); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if filepath.Dir(path) != filepath.Clean(dir) {
+		return "", fmt.Errorf("Refusing to write %s outside of %s", name, dir)
+	}
+	return path, nil
+}
+
+// validateFileName accepts file names without path separators or control
+// characters that fit on any common filesystem.
+func validateFileName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("File name is empty")
+	case len(name) > 255:
+		return fmt.Errorf("File name %q is longer than 255 bytes", name)
+	case name == "." || name == "..":
+		return fmt.Errorf("File name %q is not a file", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("File name %q contains a path separator", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("File name %q contains a control character", name)
+		}
+	}
+	return nil
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove %s. Error: %s", path, err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Unable to open directory %s. Error: %s", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync directory %s. Error: %s", dir, err)
+	}
+	return nil
+}
+
+// linkTree recreates src inside dst, hard linking files where possible. Files in
+// the rules directory are only ever replaced, never modified, so sharing inodes is safe.
+func linkTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			dest, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(dest, target)
+		default:
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
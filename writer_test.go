@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"rule.service.yaml", true},
+		{".elastalertRuleLoader.manifest.json", true},
+		{"..rule.yaml", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../rule.yaml", false},
+		{"../../etc/passwd", false},
+		{"sub/rule.yaml", false},
+		{"/etc/passwd", false},
+		{`..\rule.yaml`, false},
+		{"rule\n.yaml", false},
+		{"rule\x00.yaml", false},
+		{"rule\x7f.yaml", false},
+		{string(make([]byte, 256)), false},
+	}
+
+	for _, test := range tests {
+		path, err := safeJoin("/rules", test.name)
+		if test.ok {
+			if err != nil {
+				t.Errorf("safeJoin(%q) failed: %s", test.name, err)
+			} else if path != filepath.Join("/rules", test.name) {
+				t.Errorf("safeJoin(%q) = %q", test.name, path)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("safeJoin(%q) = %q, expected an error", test.name, path)
+		}
+	}
+}
+
+func TestWriteFileAtomicRefusesTraversal(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rules := filepath.Join(dir, "rules")
+	if err := os.Mkdir(rules, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &directRuleWriter{rules}
+	if err := writer.WriteFile("../outside.yaml", []byte("name: x\n"), 0644); err == nil {
+		t.Errorf("Wrote ../outside.yaml")
+	}
+	if err := writer.Remove("../outside.yaml"); err == nil {
+		t.Errorf("Removed ../outside.yaml")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "outside.yaml")); !os.IsNotExist(err) {
+		t.Errorf("Found a file outside of the rules directory: %v", err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "elastalertRuleLoader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestStagedRuleWriterSymlinkedParent(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	real := filepath.Join(dir, "real")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(real, filepath.Join(dir, "parent")); err != nil {
+		t.Fatal(err)
+	}
+	rules := filepath.Join(dir, "parent", "rules")
+
+	for i := 0; i < 3; i++ {
+		writer, err := newStagedRuleWriter(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteFile("rule.yaml", []byte("name: x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the rules directory link and the directory it points to
+	files, _ := filepath.Glob(filepath.Join(real, "*"))
+	if len(files) != 2 {
+		t.Errorf("Found %v, expected the rules link and a single staged directory", files)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(rules, "rule.yaml")); err != nil || string(data) != "name: x\n" {
+		t.Errorf("Rule not readable through the rules link: %q %v", data, err)
+	}
+}